@@ -0,0 +1,123 @@
+// Package auth verifies the signed tokens clients connect with, and reads
+// the claims the service cares about from them.
+package auth
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/saifwork/socket-service/configs"
+)
+
+var ErrInvalidToken = errors.New("invalid token")
+
+// Claims is what the service reads from a verified token.
+type Claims struct {
+	// The uId the token was issued to, empty when it isn't bound to one
+	Subject string
+
+	// Matchmaking tier, empty when the token doesn't carry one
+	Tier string
+}
+
+// Verifier checks the signature and validity of tokens.
+type Verifier struct {
+	parser    *jwt.Parser
+	key       interface{}
+	tierClaim string
+}
+
+// NewVerifier returns a verifier for tokens signed with the HMAC secret of
+// the config, or else with the private key matching the public key file.
+func NewVerifier(config *configs.Config) (*Verifier, error) {
+	var key interface{}
+	var methods []string
+
+	switch {
+	case config.AuthJWTSecret != "":
+		key = []byte(config.AuthJWTSecret)
+		methods = []string{"HS256", "HS384", "HS512"}
+
+	case config.AuthJWTPublicKeyFile != "":
+		var err error
+		if key, err = loadPublicKey(config.AuthJWTPublicKeyFile); err != nil {
+			return nil, err
+		}
+		switch key.(type) {
+		case *rsa.PublicKey:
+			methods = []string{"RS256", "RS384", "RS512", "PS256", "PS384", "PS512"}
+		case *ecdsa.PublicKey:
+			methods = []string{"ES256", "ES384", "ES512"}
+		case ed25519.PublicKey:
+			methods = []string{"EdDSA"}
+		default:
+			return nil, fmt.Errorf("unsupported public key type %T", key)
+		}
+
+	default:
+		return nil, errors.New("neither a secret nor a public key is configured")
+	}
+
+	opts := []jwt.ParserOption{jwt.WithValidMethods(methods)}
+	if config.AuthJWTIssuer != "" {
+		opts = append(opts, jwt.WithIssuer(config.AuthJWTIssuer))
+	}
+	if config.AuthJWTAudience != "" {
+		opts = append(opts, jwt.WithAudience(config.AuthJWTAudience))
+	}
+
+	return &Verifier{
+		parser:    jwt.NewParser(opts...),
+		key:       key,
+		tierClaim: config.AuthTierClaim,
+	}, nil
+}
+
+// Verify checks a token and returns its claims. Tokens with a bad
+// signature, expired or not valid yet are rejected with ErrInvalidToken.
+func (v *Verifier) Verify(token string) (*Claims, error) {
+	claims := jwt.MapClaims{}
+	_, err := v.parser.ParseWithClaims(token, claims, func(*jwt.Token) (interface{}, error) {
+		return v.key, nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrInvalidToken, err)
+	}
+
+	subject, err := claims.GetSubject()
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrInvalidToken, err)
+	}
+
+	var tier string
+	if raw, ok := claims[v.tierClaim]; ok {
+		if tier, ok = raw.(string); !ok {
+			return nil, fmt.Errorf("%w: %s claim must be a string", ErrInvalidToken, v.tierClaim)
+		}
+	}
+
+	return &Claims{Subject: subject, Tier: tier}, nil
+}
+
+func loadPublicKey(path string) (interface{}, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("no PEM data in %s", path)
+	}
+	if block.Type == "RSA PUBLIC KEY" {
+		return x509.ParsePKCS1PublicKey(block.Bytes)
+	}
+	return x509.ParsePKIXPublicKey(block.Bytes)
+}
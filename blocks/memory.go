@@ -0,0 +1,45 @@
+package blocks
+
+import (
+	"context"
+	"sync"
+)
+
+// MemoryStore keeps blocks in memory, they survive reconnects but not
+// restarts.
+type MemoryStore struct {
+	mu     sync.Mutex
+	blocks map[string]map[string]bool
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{blocks: make(map[string]map[string]bool)}
+}
+
+func (m *MemoryStore) Block(_ context.Context, uid, blocked string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, pair := range [][2]string{{uid, blocked}, {blocked, uid}} {
+		if m.blocks[pair[0]] == nil {
+			m.blocks[pair[0]] = make(map[string]bool)
+		}
+		m.blocks[pair[0]][pair[1]] = true
+	}
+	return nil
+}
+
+func (m *MemoryStore) Blocked(_ context.Context, uid string) ([]string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var blocked []string
+	for other := range m.blocks[uid] {
+		blocked = append(blocked, other)
+	}
+	return blocked, nil
+}
+
+func (m *MemoryStore) Close() error {
+	return nil
+}
@@ -0,0 +1,37 @@
+// Package blocks persists the users each user blocked, so they are never
+// paired again.
+package blocks
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/saifwork/socket-service/configs"
+)
+
+// Store persists blocks between uIds.
+type Store interface {
+	// Block records that uid blocked blocked. Blocking twice is no error.
+	Block(ctx context.Context, uid, blocked string) error
+
+	// Blocked returns the uIds uid blocked or was blocked by, which it
+	// must never be paired with.
+	Blocked(ctx context.Context, uid string) ([]string, error)
+
+	Close() error
+}
+
+// Open returns the store selected by the config: "memory", "sqlite" or
+// "postgres".
+func Open(config *configs.Config) (Store, error) {
+	switch config.BlockStore {
+	case "memory":
+		return NewMemoryStore(), nil
+	case "sqlite":
+		return NewSQLiteStore(config.BlockStoreDSN)
+	case "postgres":
+		return NewPostgresStore(config.BlockStoreDSN)
+	default:
+		return nil, fmt.Errorf("unknown block store %q", config.BlockStore)
+	}
+}
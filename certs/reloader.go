@@ -0,0 +1,143 @@
+package certs
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// Reloader serves a TLS certificate loaded from disk and picks up new
+// versions of the cert/key pair when they change, so renewed certificates
+// take effect without restarting the service.
+type Reloader struct {
+	certFile string
+	keyFile  string
+
+	mu   sync.RWMutex
+	cert *tls.Certificate
+
+	// Modification times of the cert and key files the certificate was
+	// loaded from
+	modTimes [2]time.Time
+}
+
+// Interval Watch falls back to when given a non positive one.
+const defaultWatchInterval = 30 * time.Second
+
+// NewReloader loads the cert/key pair once and returns a Reloader for it.
+func NewReloader(certFile, keyFile string) (*Reloader, error) {
+	r := &Reloader{certFile: certFile, keyFile: keyFile}
+	if err := r.reload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// GetCertificate returns the current certificate. It is meant to be used
+// as tls.Config.GetCertificate.
+func (r *Reloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.cert, nil
+}
+
+// ServerConfig returns the TLS config of a server presenting the current
+// certificate. When clientCAs is set, clients must present a certificate
+// signed by one of them.
+func (r *Reloader) ServerConfig(clientCAs *x509.CertPool) *tls.Config {
+	config := &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		GetCertificate: r.GetCertificate,
+	}
+	if clientCAs != nil {
+		config.ClientCAs = clientCAs
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return config
+}
+
+// Watch checks the cert and key files every interval and reloads them when
+// either one has been modified. Any change of modification time counts, as
+// tools such as cp -p, tar or symlink swaps can put older files in place.
+// A failed reload keeps the previous certificate in place. Watch blocks, so
+// run it in its own goroutine.
+func (r *Reloader) Watch(interval time.Duration) {
+	if interval <= 0 {
+		log.Printf("Invalid certificate reload interval %s, using %s", interval, defaultWatchInterval)
+		interval = defaultWatchInterval
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		modTimes, err := r.fileModTimes()
+		if err != nil {
+			log.Printf("Failed to stat certificate files: %s", err)
+			continue
+		}
+
+		r.mu.RLock()
+		changed := !modTimes[0].Equal(r.modTimes[0]) || !modTimes[1].Equal(r.modTimes[1])
+		r.mu.RUnlock()
+		if !changed {
+			continue
+		}
+
+		if err := r.reload(); err != nil {
+			log.Printf("Failed to reload certificate, keeping the current one: %s", err)
+			continue
+		}
+		log.Printf("Reloaded certificate from %s", r.certFile)
+	}
+}
+
+func (r *Reloader) reload() error {
+	modTimes, err := r.fileModTimes()
+	if err != nil {
+		return err
+	}
+
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return fmt.Errorf("load key pair: %w", err)
+	}
+
+	r.mu.Lock()
+	r.cert = &cert
+	r.modTimes = modTimes
+	r.mu.Unlock()
+	return nil
+}
+
+// fileModTimes returns the modification times of the cert and key files.
+func (r *Reloader) fileModTimes() ([2]time.Time, error) {
+	var modTimes [2]time.Time
+	for i, name := range []string{r.certFile, r.keyFile} {
+		info, err := os.Stat(name)
+		if err != nil {
+			return modTimes, err
+		}
+		modTimes[i] = info.ModTime()
+	}
+	return modTimes, nil
+}
+
+// LoadCertPool reads a PEM bundle of CA certificates, used to verify client
+// certificates on mTLS endpoints.
+func LoadCertPool(caFile string) (*x509.CertPool, error) {
+	pem, err := os.ReadFile(caFile)
+	if err != nil {
+		return nil, err
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificates found in %s", caFile)
+	}
+	return pool, nil
+}
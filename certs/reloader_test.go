@@ -0,0 +1,245 @@
+package certs
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// testCert is a certificate with its key, signed by a parent or by itself.
+type testCert struct {
+	cert *x509.Certificate
+	der  []byte
+	key  *ecdsa.PrivateKey
+}
+
+var serial int64
+
+// newCert generates a certificate for name, signed by parent, or a self
+// signed CA, valid for any usage, when parent is nil.
+func newCert(t *testing.T, name string, parent *testCert, usage x509.ExtKeyUsage) *testCert {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	serial++
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Minute),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{usage},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+	}
+
+	signer, signerKey := template, key
+	if parent == nil {
+		template.IsCA = true
+		template.ExtKeyUsage = nil
+		template.BasicConstraintsValid = true
+		template.KeyUsage |= x509.KeyUsageCertSign
+	} else {
+		signer, signerKey = parent.cert, parent.key
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, signer, &key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testCert{cert: cert, der: der, key: key}
+}
+
+// write saves the certificate and key as PEM files, returning their paths.
+func (c *testCert) write(t *testing.T, dir, name string) (string, string) {
+	t.Helper()
+
+	keyDER, err := x509.MarshalECPrivateKey(c.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	certFile := filepath.Join(dir, name+".crt")
+	keyFile := filepath.Join(dir, name+".key")
+	writePEM(t, certFile, "CERTIFICATE", c.der)
+	writePEM(t, keyFile, "EC PRIVATE KEY", keyDER)
+	return certFile, keyFile
+}
+
+func (c *testCert) tlsCertificate() tls.Certificate {
+	return tls.Certificate{Certificate: [][]byte{c.der}, PrivateKey: c.key}
+}
+
+func writePEM(t *testing.T, path, blockType string, der []byte) {
+	t.Helper()
+
+	data := pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der})
+	if err := os.WriteFile(path, data, 0o600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func serving(t *testing.T, r *Reloader) *x509.Certificate {
+	t.Helper()
+
+	cert, err := r.GetCertificate(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return leaf
+}
+
+func TestReloaderPicksUpNewCertificate(t *testing.T) {
+	// Dates for the new files, relative to the old ones, whatever the clock
+	// resolution of the file system
+	tests := []struct {
+		name                string
+		certShift, keyShift time.Duration
+	}{
+		{"newer files", time.Minute, time.Minute},
+		{"older files, as copied with cp -p", -time.Hour, -time.Hour},
+		{"older cert next to an unchanged key date", -time.Hour, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			ca := newCert(t, "ca", nil, x509.ExtKeyUsageServerAuth)
+			certFile, keyFile := newCert(t, "old", ca, x509.ExtKeyUsageServerAuth).write(t, dir, "server")
+
+			r, err := NewReloader(certFile, keyFile)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := serving(t, r).Subject.CommonName; got != "old" {
+				t.Fatalf("serving %q, want old", got)
+			}
+			old := r.modTimes
+			go r.Watch(10 * time.Millisecond)
+
+			newCert(t, "new", ca, x509.ExtKeyUsageServerAuth).write(t, dir, "server")
+			for i, f := range []struct {
+				name  string
+				shift time.Duration
+			}{{certFile, tt.certShift}, {keyFile, tt.keyShift}} {
+				at := old[i].Add(f.shift)
+				if err := os.Chtimes(f.name, at, at); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			deadline := time.Now().Add(2 * time.Second)
+			for serving(t, r).Subject.CommonName != "new" {
+				if time.Now().After(deadline) {
+					t.Fatal("the new certificate was not picked up")
+				}
+				time.Sleep(10 * time.Millisecond)
+			}
+		})
+	}
+}
+
+func TestReloaderKeepsCertificateOnBadPair(t *testing.T) {
+	dir := t.TempDir()
+	ca := newCert(t, "ca", nil, x509.ExtKeyUsageServerAuth)
+	certFile, keyFile := newCert(t, "good", ca, x509.ExtKeyUsageServerAuth).write(t, dir, "server")
+
+	r, err := NewReloader(certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A cert not matching the key, as seen halfway through a renewal
+	newCert(t, "other", ca, x509.ExtKeyUsageServerAuth).write(t, dir, "other")
+	other, err := os.ReadFile(filepath.Join(dir, "other.crt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(certFile, other, 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := r.reload(); err == nil {
+		t.Fatal("mismatched pair was loaded")
+	}
+	if got := serving(t, r).Subject.CommonName; got != "good" {
+		t.Fatalf("serving %q, want good", got)
+	}
+}
+
+func TestServerConfigRequiresClientCertificate(t *testing.T) {
+	dir := t.TempDir()
+	ca := newCert(t, "ca", nil, x509.ExtKeyUsageServerAuth)
+	certFile, keyFile := newCert(t, "admin", ca, x509.ExtKeyUsageServerAuth).write(t, dir, "server")
+	caFile, _ := ca.write(t, dir, "ca")
+
+	r, err := NewReloader(certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool, err := LoadCertPool(caFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Served by hand, httptest would put its own certificate first
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", r.ServerConfig(pool))
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})}
+	go srv.Serve(listener)
+	defer srv.Close()
+	url := "https://" + listener.Addr().String()
+
+	clientFor := func(certs ...tls.Certificate) *http.Client {
+		return &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{
+			RootCAs:      pool,
+			Certificates: certs,
+		}}}
+	}
+
+	if resp, err := clientFor().Get(url); err == nil {
+		resp.Body.Close()
+		t.Fatal("client without a certificate got through")
+	}
+
+	stranger := newCert(t, "stranger", nil, x509.ExtKeyUsageClientAuth)
+	if resp, err := clientFor(newCert(t, "stranger", stranger, x509.ExtKeyUsageClientAuth).tlsCertificate()).Get(url); err == nil {
+		resp.Body.Close()
+		t.Fatal("client with a certificate of another CA got through")
+	}
+
+	resp, err := clientFor(newCert(t, "operator", ca, x509.ExtKeyUsageClientAuth).tlsCertificate()).Get(url)
+	if err != nil {
+		t.Fatalf("client with a valid certificate: %s", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("status %d, want 200", resp.StatusCode)
+	}
+}
@@ -3,6 +3,9 @@ package configs
 import (
 	"log"
 	"os"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/joho/godotenv"
 )
@@ -11,14 +14,168 @@ type Config struct {
 	ServiceName string
 	ServiceHost string
 	ServicePort string
+
+	// TLS termination, enabled when both the cert and key files are set
+	TLSCertFile       string
+	TLSKeyFile        string
+	TLSReloadInterval time.Duration
+
+	// Admin endpoints, served on their own port when AdminPort is set.
+	// Client certificates signed by AdminClientCAFile are required when set,
+	// and the call history is only served then.
+	AdminPort         string
+	AdminClientCAFile string
+
+	// How long a dropped client keeps its partner and session while it
+	// reconnects with its resume token. Zero disables resumption.
+	ResumeGrace time.Duration
+
+	// Maximum number of members in a group call room
+	RoomCapacity int
+
+	// How long a private invite code stays valid
+	InviteTTL time.Duration
+
+	// Largest message accepted from a client, in bytes
+	MaxMessageSize int
+
+	// permessage-deflate settings. Messages smaller than the threshold are
+	// sent uncompressed.
+	CompressionEnabled   bool
+	CompressionThreshold int
+	CompressionLevel     int
+
+	// What to do when a client's outbound buffer is full, per message
+	// class: "drop_oldest", "drop_presence" or "disconnect". Clients that
+	// stay full for BackpressureTimeout are disconnected.
+	BackpressurePresence  string
+	BackpressureSignaling string
+	BackpressureControl   string
+	BackpressureTimeout   time.Duration
+
+	// Presence updates are coalesced and sent at most once per interval,
+	// only when they changed
+	PresenceInterval time.Duration
+
+	// How often waiting clients are told their place in the pool
+	QueueStatusInterval time.Duration
+
+	// How long both sides of a match have to accept it
+	MatchAckTimeout time.Duration
+
+	// Inspect the SDP of offers and answers and enforce the policy below
+	// on it. Codecs are given by name, e.g. "VP8,H264"; KeepCodecs wins
+	// over StripCodecs. SDPMaxBandwidth caps b=AS and b=TIAS, in kbps.
+	SDPInspection         bool
+	SDPStripCodecs        []string
+	SDPKeepCodecs         []string
+	SDPMaxBandwidth       int
+	SDPForbidDataChannels bool
+	SDPForbidVideo        bool
+
+	// Remove host candidates from SDPs, which carry private addresses
+	SDPStripHostCandidates bool
+
+	// Keep the addresses of every client from their peers: only relay
+	// candidates are forwarded and clients are told to use relay only.
+	// Clients can also ask for it with the privacy query parameter.
+	PrivacyMode bool
+
+	// Embedded TURN/STUN server, listening on UDP and TCP on
+	// TURNListenAddr and relaying on TURNPublicIP within the port range.
+	// TURNURLs overrides the URLs given to clients, and TURNSecret, when
+	// set, signs credentials the same across restarts.
+	TURNEnabled       bool
+	TURNListenAddr    string
+	TURNPublicIP      string
+	TURNRelayMinPort  int
+	TURNRelayMaxPort  int
+	TURNRealm         string
+	TURNURLs          []string
+	TURNSecret        string
+	TURNCredentialTTL time.Duration
+
+	// Cap on concurrent allocations, and on the bytes an allocation may
+	// relay before it is closed. Zero means no cap.
+	TURNMaxAllocations  int
+	TURNAllocationQuota int64
+
+	// Let clients relay to loopback, private and link-local addresses,
+	// which are refused by default to keep the local network out of reach
+	TURNAllowPrivatePeers bool
+
+	// Where ended sessions are recorded: "memory", "sqlite" or "postgres".
+	// The DSN is the database to use; the memory store keeps the most
+	// recent SessionStoreMemoryLimit records.
+	SessionStore            string
+	SessionStoreDSN         string
+	SessionStoreMemoryLimit int
+
+	// How many recent partners per user the matcher avoids, for how long,
+	// and after how long without any other candidate a user may be paired
+	// with a recent partner anyway. A zero history disables it.
+	RecentPartnerHistory  int
+	RecentPartnerTTL      time.Duration
+	RecentPartnerFallback time.Duration
+
+	// Where the users each user blocked are kept: "memory", "sqlite" or
+	// "postgres", with the DSN of the database to use.
+	BlockStore    string
+	BlockStoreDSN string
+
+	// Pair clients near each other first. Within RegionWaitBudget only
+	// clients in the same region, or within RegionRadius km, are paired;
+	// the radius then grows by RegionRadiusGrowth km per second, and
+	// anyone goes after RegionMaxWait. Clients not reporting a location
+	// are located with the GeoIP database at GeoIPFile, when set.
+	RegionMatching     bool
+	RegionWaitBudget   time.Duration
+	RegionRadius       float64
+	RegionRadiusGrowth float64
+	RegionMaxWait      time.Duration
+	GeoIPFile          string
+
+	// Clients waiting longer than this are paired first, with any partner
+	// passing their hard filters. Zero disables it.
+	MatchMaxWait time.Duration
+
+	// Tokens clients connect with, in the token query parameter or as a
+	// bearer token, signed with AuthJWTSecret or else the private key of
+	// AuthJWTPublicKeyFile. A token bound to a subject is only valid for
+	// that uId. Clients without a token are let in, on the default tier,
+	// unless AuthRequired.
+	AuthJWTSecret        string
+	AuthJWTPublicKeyFile string
+	AuthJWTIssuer        string
+	AuthJWTAudience      string
+	AuthRequired         bool
+	AuthTierClaim        string
+
+	// Matchmaking tiers, read from the tier claim of the token. Tiers
+	// missing from TierWeights fall back to TierDefault. The weight of a
+	// tier scales its chances to be paired first, e.g. "free:1,premium:4";
+	// only the TierFilterAccess tiers, or every tier with "*", may set hard
+	// filters, and anyone may while authentication is disabled. Overdue
+	// clients still go first whatever their tier, see MatchMaxWait.
+	TierDefault      string
+	TierWeights      map[string]float64
+	TierFilterAccess []string
 }
 
+// Backpressure policies, see the Backpressure fields.
+var backpressurePolicies = []string{"drop_oldest", "drop_presence", "disconnect"}
+
 func NewConfig() *Config {
 	c := Config{}
 	c.initialise()
 	return &c
 }
 
+// TLSEnabled reports whether the service should terminate TLS itself.
+func (c *Config) TLSEnabled() bool {
+	return c.TLSCertFile != "" && c.TLSKeyFile != ""
+}
+
 func (c *Config) initialise() {
 	// Load config
 	if err := godotenv.Load(".env"); err != nil {
@@ -39,4 +196,225 @@ func (c *Config) initialise() {
 		log.Println("SERVICE_PORT missed on the environment variables, setting default to '8080'")
 		c.ServicePort = "8080"
 	}
+
+	c.TLSCertFile = os.Getenv("TLS_CERT_FILE")
+	c.TLSKeyFile = os.Getenv("TLS_KEY_FILE")
+	c.TLSReloadInterval = getEnvPositiveDuration("TLS_RELOAD_INTERVAL", 30*time.Second)
+
+	c.AdminPort = os.Getenv("ADMIN_PORT")
+	c.AdminClientCAFile = os.Getenv("ADMIN_CLIENT_CA_FILE")
+
+	c.ResumeGrace = getEnvDuration("RESUME_GRACE", 30*time.Second)
+
+	c.RoomCapacity = getEnvInt("ROOM_CAPACITY", 6)
+
+	c.InviteTTL = getEnvDuration("INVITE_TTL", 10*time.Minute)
+
+	c.MaxMessageSize = getEnvInt("MAX_MESSAGE_SIZE", 64*1024)
+
+	c.CompressionEnabled = getEnvBool("COMPRESSION_ENABLED", true)
+	c.CompressionThreshold = getEnvInt("COMPRESSION_THRESHOLD", 512)
+	c.CompressionLevel = getEnvInt("COMPRESSION_LEVEL", 1)
+
+	c.BackpressurePresence = getEnvChoice("BACKPRESSURE_PRESENCE", "drop_oldest", backpressurePolicies...)
+	c.BackpressureSignaling = getEnvChoice("BACKPRESSURE_SIGNALING", "drop_presence", backpressurePolicies...)
+	c.BackpressureControl = getEnvChoice("BACKPRESSURE_CONTROL", "disconnect", backpressurePolicies...)
+	c.BackpressureTimeout = getEnvDuration("BACKPRESSURE_TIMEOUT", 2*time.Second)
+
+	c.PresenceInterval = getEnvDuration("PRESENCE_INTERVAL", 2*time.Second)
+
+	c.QueueStatusInterval = getEnvDuration("QUEUE_STATUS_INTERVAL", 5*time.Second)
+
+	c.MatchAckTimeout = getEnvDuration("MATCH_ACK_TIMEOUT", 10*time.Second)
+
+	c.SDPInspection = getEnvBool("SDP_INSPECTION", false)
+	c.SDPStripCodecs = getEnvList("SDP_STRIP_CODECS")
+	c.SDPKeepCodecs = getEnvList("SDP_KEEP_CODECS")
+	c.SDPMaxBandwidth = getEnvInt("SDP_MAX_BANDWIDTH", 0)
+	c.SDPForbidDataChannels = getEnvBool("SDP_FORBID_DATA_CHANNELS", false)
+	c.SDPForbidVideo = getEnvBool("SDP_FORBID_VIDEO", false)
+	c.SDPStripHostCandidates = getEnvBool("SDP_STRIP_HOST_CANDIDATES", false)
+
+	c.PrivacyMode = getEnvBool("PRIVACY_MODE", false)
+
+	c.TURNEnabled = getEnvBool("TURN_ENABLED", false)
+	c.TURNListenAddr = getEnv("TURN_LISTEN_ADDR", "0.0.0.0:3478")
+	if c.TURNPublicIP = os.Getenv("TURN_PUBLIC_IP"); c.TURNPublicIP == "" {
+		if c.TURNEnabled {
+			log.Println("TURN_PUBLIC_IP missed on the environment variables, setting default to '127.0.0.1'")
+		}
+		c.TURNPublicIP = "127.0.0.1"
+	}
+	c.TURNRelayMinPort = getEnvInt("TURN_RELAY_MIN_PORT", 49152)
+	c.TURNRelayMaxPort = getEnvInt("TURN_RELAY_MAX_PORT", 65535)
+	c.TURNRealm = getEnv("TURN_REALM", c.ServiceName)
+	c.TURNURLs = getEnvList("TURN_URLS")
+	c.TURNSecret = os.Getenv("TURN_SECRET")
+	c.TURNCredentialTTL = getEnvDuration("TURN_CREDENTIAL_TTL", time.Hour)
+	c.TURNMaxAllocations = getEnvInt("TURN_MAX_ALLOCATIONS", 1000)
+	c.TURNAllocationQuota = int64(getEnvInt("TURN_ALLOCATION_QUOTA", 0))
+	c.TURNAllowPrivatePeers = getEnvBool("TURN_ALLOW_PRIVATE_PEERS", false)
+
+	c.SessionStore = getEnv("SESSION_STORE", "memory")
+	c.SessionStoreDSN = os.Getenv("SESSION_STORE_DSN")
+	c.SessionStoreMemoryLimit = getEnvInt("SESSION_STORE_MEMORY_LIMIT", 10000)
+
+	c.RecentPartnerHistory = getEnvInt("RECENT_PARTNER_HISTORY", 5)
+	c.RecentPartnerTTL = getEnvDuration("RECENT_PARTNER_TTL", 10*time.Minute)
+	c.RecentPartnerFallback = getEnvDuration("RECENT_PARTNER_FALLBACK", 30*time.Second)
+
+	c.BlockStore = getEnv("BLOCK_STORE", "memory")
+	c.BlockStoreDSN = os.Getenv("BLOCK_STORE_DSN")
+
+	c.RegionMatching = getEnvBool("REGION_MATCHING", true)
+	c.RegionWaitBudget = getEnvDuration("REGION_WAIT_BUDGET", 10*time.Second)
+	c.RegionRadius = float64(getEnvInt("REGION_RADIUS", 1000))
+	c.RegionRadiusGrowth = float64(getEnvInt("REGION_RADIUS_GROWTH", 200))
+	c.RegionMaxWait = getEnvDuration("REGION_MAX_WAIT", time.Minute)
+	c.GeoIPFile = os.Getenv("GEOIP_FILE")
+
+	c.MatchMaxWait = getEnvDuration("MATCH_MAX_WAIT", 45*time.Second)
+
+	c.AuthJWTSecret = os.Getenv("AUTH_JWT_SECRET")
+	c.AuthJWTPublicKeyFile = os.Getenv("AUTH_JWT_PUBLIC_KEY_FILE")
+	c.AuthJWTIssuer = os.Getenv("AUTH_JWT_ISSUER")
+	c.AuthJWTAudience = os.Getenv("AUTH_JWT_AUDIENCE")
+	c.AuthRequired = getEnvBool("AUTH_REQUIRED", false)
+	c.AuthTierClaim = getEnv("AUTH_TIER_CLAIM", "tier")
+
+	c.TierDefault = getEnv("TIER_DEFAULT", "free")
+	c.TierWeights = getEnvWeights("TIER_WEIGHTS", "free:1,premium:4")
+	if _, ok := c.TierWeights[c.TierDefault]; !ok {
+		c.TierWeights[c.TierDefault] = 1
+	}
+	if c.TierFilterAccess = getEnvList("TIER_FILTER_ACCESS"); c.TierFilterAccess == nil {
+		c.TierFilterAccess = []string{"premium"}
+	}
+
+	if c.AuthRequired && !c.AuthEnabled() {
+		log.Println("AUTH_REQUIRED is set without AUTH_JWT_SECRET or AUTH_JWT_PUBLIC_KEY_FILE, no client will be let in")
+	}
+}
+
+// AuthEnabled reports whether clients can authenticate with a token.
+func (c *Config) AuthEnabled() bool {
+	return c.AuthJWTSecret != "" || c.AuthJWTPublicKeyFile != ""
+}
+
+// getEnv reads an environment variable, falling back to def when it is
+// missing.
+func getEnv(key, def string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return def
+}
+
+// getEnvChoice reads an environment variable that must be one of choices,
+// falling back to def when it is missing or isn't.
+func getEnvChoice(key, def string, choices ...string) string {
+	v := os.Getenv(key)
+	if v == "" {
+		return def
+	}
+	for _, choice := range choices {
+		if v == choice {
+			return v
+		}
+	}
+	log.Printf("%s must be one of %s, setting default to '%s'", key, strings.Join(choices, ", "), def)
+	return def
+}
+
+// getEnvInt reads an integer environment variable, falling back to def when
+// it is missing or malformed.
+func getEnvInt(key string, def int) int {
+	v := os.Getenv(key)
+	if v == "" {
+		return def
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil {
+		log.Printf("%s is not a valid integer, setting default to '%d'", key, def)
+		return def
+	}
+	return n
+}
+
+// getEnvBool reads a boolean environment variable such as "true" or "0",
+// falling back to def when it is missing or malformed.
+func getEnvBool(key string, def bool) bool {
+	v := os.Getenv(key)
+	if v == "" {
+		return def
+	}
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		log.Printf("%s is not a valid boolean, setting default to '%t'", key, def)
+		return def
+	}
+	return b
+}
+
+// getEnvList reads a comma separated environment variable, skipping empty
+// entries.
+func getEnvList(key string) []string {
+	var list []string
+	for _, v := range strings.Split(os.Getenv(key), ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			list = append(list, v)
+		}
+	}
+	return list
+}
+
+// getEnvWeights reads a comma separated list of name:weight pairs, such as
+// "free:1,premium:4", falling back to def when it is missing. Malformed or
+// non positive weights are skipped.
+func getEnvWeights(key, def string) map[string]float64 {
+	v := os.Getenv(key)
+	if v == "" {
+		v = def
+	}
+
+	weights := make(map[string]float64)
+	for _, pair := range strings.Split(v, ",") {
+		name, weight, _ := strings.Cut(strings.TrimSpace(pair), ":")
+		w, err := strconv.ParseFloat(strings.TrimSpace(weight), 64)
+		if name = strings.TrimSpace(name); name == "" || err != nil || w <= 0 {
+			log.Printf("%s has an invalid weight %q, skipping it", key, pair)
+			continue
+		}
+		weights[name] = w
+	}
+	return weights
+}
+
+// getEnvDuration reads a duration environment variable such as "30s" or
+// "5m". A bare number is taken as seconds.
+func getEnvDuration(key string, def time.Duration) time.Duration {
+	v := os.Getenv(key)
+	if v == "" {
+		return def
+	}
+	if n, err := strconv.Atoi(v); err == nil {
+		return time.Duration(n) * time.Second
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		log.Printf("%s is not a valid duration, setting default to '%s'", key, def)
+		return def
+	}
+	return d
+}
+
+// getEnvPositiveDuration reads a duration like getEnvDuration, falling back
+// to def when it isn't positive.
+func getEnvPositiveDuration(key string, def time.Duration) time.Duration {
+	d := getEnvDuration(key, def)
+	if d <= 0 {
+		log.Printf("%s must be positive, setting default to '%s'", key, def)
+		return def
+	}
+	return d
 }
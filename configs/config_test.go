@@ -0,0 +1,28 @@
+package configs
+
+import (
+	"testing"
+	"time"
+)
+
+func TestGetEnvPositiveDuration(t *testing.T) {
+	tests := []struct {
+		value string
+		want  time.Duration
+	}{
+		{"", 30 * time.Second},
+		{"10", 10 * time.Second},
+		{"1m", time.Minute},
+		{"0", 30 * time.Second},
+		{"0s", 30 * time.Second},
+		{"-5s", 30 * time.Second},
+		{"soon", 30 * time.Second},
+	}
+
+	for _, tt := range tests {
+		t.Setenv("TLS_RELOAD_INTERVAL", tt.value)
+		if got := getEnvPositiveDuration("TLS_RELOAD_INTERVAL", 30*time.Second); got != tt.want {
+			t.Errorf("%q: got %s, want %s", tt.value, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,101 @@
+// Package geo locates clients coarsely, from what they report or from
+// their IP address through a local GeoIP database, to pair clients that
+// are close to each other.
+package geo
+
+import (
+	"math"
+	"net"
+	"strings"
+
+	"github.com/oschwald/maxminddb-golang"
+)
+
+// Mean radius of the earth, in km.
+const earthRadius = 6371.0
+
+// Location is where a client is, as precisely as it is known. Regions are
+// compared as is; the ones derived from GeoIP are continent codes such as
+// "EU" or "NA".
+type Location struct {
+	Region    string
+	Lat, Lon  float64
+	HasCoords bool
+}
+
+// Known reports whether anything is known about the location.
+func (l Location) Known() bool {
+	return l.Region != "" || l.HasCoords
+}
+
+// Distance returns the distance between two locations in km. With
+// coordinates on both sides it is the great-circle distance; otherwise the
+// same region is at zero distance and different regions infinitely far.
+// It reports false when there isn't enough to compare.
+func Distance(a, b Location) (float64, bool) {
+	if a.HasCoords && b.HasCoords {
+		return haversine(a.Lat, a.Lon, b.Lat, b.Lon), true
+	}
+	if a.Region != "" && b.Region != "" {
+		if strings.EqualFold(a.Region, b.Region) {
+			return 0, true
+		}
+		return math.Inf(1), true
+	}
+	return 0, false
+}
+
+func haversine(lat1, lon1, lat2, lon2 float64) float64 {
+	rad := math.Pi / 180
+	dLat := (lat2 - lat1) * rad
+	dLon := (lon2 - lon1) * rad
+
+	h := math.Sin(dLat/2)*math.Sin(dLat/2) +
+		math.Cos(lat1*rad)*math.Cos(lat2*rad)*math.Sin(dLon/2)*math.Sin(dLon/2)
+	return 2 * earthRadius * math.Asin(math.Sqrt(h))
+}
+
+// Locator looks up IP addresses in a MaxMind GeoIP2 or GeoLite2 City or
+// Country database.
+type Locator struct {
+	db *maxminddb.Reader
+}
+
+// record is the part of a GeoIP2 record the locator uses.
+type record struct {
+	Continent struct {
+		Code string `maxminddb:"code"`
+	} `maxminddb:"continent"`
+	Location struct {
+		Latitude  *float64 `maxminddb:"latitude"`
+		Longitude *float64 `maxminddb:"longitude"`
+	} `maxminddb:"location"`
+}
+
+// OpenLocator opens the GeoIP database at path.
+func OpenLocator(path string) (*Locator, error) {
+	db, err := maxminddb.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	return &Locator{db: db}, nil
+}
+
+// Lookup returns the location of an IP address, or reports false when the
+// database doesn't know it.
+func (l *Locator) Lookup(ip net.IP) (Location, bool) {
+	var r record
+	if err := l.db.Lookup(ip, &r); err != nil {
+		return Location{}, false
+	}
+
+	loc := Location{Region: r.Continent.Code}
+	if r.Location.Latitude != nil && r.Location.Longitude != nil {
+		loc.Lat, loc.Lon, loc.HasCoords = *r.Location.Latitude, *r.Location.Longitude, true
+	}
+	return loc, loc.Known()
+}
+
+func (l *Locator) Close() error {
+	return l.db.Close()
+}
@@ -0,0 +1,69 @@
+package history
+
+import (
+	"context"
+	"sort"
+	"sync"
+)
+
+// MemoryStore keeps the most recent records in memory, they are lost on
+// restart.
+type MemoryStore struct {
+	mu      sync.Mutex
+	records []*Record
+	limit   int
+}
+
+// NewMemoryStore returns a store keeping up to limit records, dropping the
+// oldest ones first.
+func NewMemoryStore(limit int) *MemoryStore {
+	return &MemoryStore{limit: limit}
+}
+
+func (m *MemoryStore) Save(_ context.Context, r *Record) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.records = append(m.records, r)
+	if m.limit > 0 && len(m.records) > m.limit {
+		m.records = append([]*Record(nil), m.records[len(m.records)-m.limit:]...)
+	}
+	return nil
+}
+
+// Find goes through the records newest first. They are saved as sessions
+// end, so they are sorted by match time, as the SQL stores do, before the
+// limit applies.
+func (m *MemoryStore) Find(_ context.Context, q Query) ([]*Record, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	limit := q.Limit
+	if limit <= 0 {
+		limit = defaultLimit
+	}
+
+	var found []*Record
+	for i := len(m.records) - 1; i >= 0; i-- {
+		r := m.records[i]
+		if q.UID != "" && r.OffererID != q.UID && r.AnswererID != q.UID {
+			continue
+		}
+		if !q.Since.IsZero() && r.MatchedAt.Before(q.Since) {
+			continue
+		}
+		found = append(found, r)
+	}
+
+	sort.SliceStable(found, func(i, j int) bool {
+		return found[i].MatchedAt.After(found[j].MatchedAt)
+	})
+	if len(found) > limit {
+		found = found[:limit]
+	}
+	return found, nil
+}
+
+func (m *MemoryStore) Close() error {
+	return nil
+}
@@ -0,0 +1,91 @@
+// Package history keeps a record of every pairing once it ended: who was
+// paired, how long they took to connect, how long the call lasted and how
+// it ended.
+package history
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/saifwork/socket-service/configs"
+)
+
+// Where the two clients of a session came from.
+const (
+	SourcePool   = "pool"
+	SourceInvite = "invite"
+)
+
+// Record is an ended session.
+type Record struct {
+	SessionID  string `json:"sessionId"`
+	OffererID  string `json:"offererId"`
+	AnswererID string `json:"answererId"`
+	Source     string `json:"source"`
+
+	MatchedAt   time.Time  `json:"matchedAt"`
+	ConnectedAt *time.Time `json:"connectedAt,omitempty"`
+	EndedAt     time.Time  `json:"endedAt"`
+	EndReason   string     `json:"endReason"`
+
+	// Milliseconds from the match to the first answer, -1 when the clients
+	// never connected, and from then on to the end of the call.
+	TimeToConnectedMs int64 `json:"timeToConnectedMs"`
+	DurationMs        int64 `json:"durationMs"`
+}
+
+// NewRecord builds the record of a session. connectedAt is zero when the
+// clients never connected.
+func NewRecord(sessionID, offererID, answererID, source string, matchedAt, connectedAt, endedAt time.Time, endReason string) *Record {
+	r := &Record{
+		SessionID:         sessionID,
+		OffererID:         offererID,
+		AnswererID:        answererID,
+		Source:            source,
+		MatchedAt:         matchedAt,
+		EndedAt:           endedAt,
+		EndReason:         endReason,
+		TimeToConnectedMs: -1,
+	}
+
+	if !connectedAt.IsZero() {
+		r.ConnectedAt = &connectedAt
+		r.TimeToConnectedMs = connectedAt.Sub(matchedAt).Milliseconds()
+		r.DurationMs = endedAt.Sub(connectedAt).Milliseconds()
+	}
+	return r
+}
+
+// Query selects records, most recent first. UID matches either side of the
+// session; zero fields don't filter.
+type Query struct {
+	UID   string
+	Since time.Time
+	Limit int
+}
+
+// Store persists session records.
+type Store interface {
+	Save(ctx context.Context, r *Record) error
+	Find(ctx context.Context, q Query) ([]*Record, error)
+	Close() error
+}
+
+// Default number of records Find returns.
+const defaultLimit = 100
+
+// Open returns the store selected by the config: "memory", "sqlite" or
+// "postgres".
+func Open(config *configs.Config) (Store, error) {
+	switch config.SessionStore {
+	case "memory":
+		return NewMemoryStore(config.SessionStoreMemoryLimit), nil
+	case "sqlite":
+		return NewSQLiteStore(config.SessionStoreDSN)
+	case "postgres":
+		return NewPostgresStore(config.SessionStoreDSN)
+	default:
+		return nil, fmt.Errorf("unknown session store %q", config.SessionStore)
+	}
+}
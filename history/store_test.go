@@ -0,0 +1,152 @@
+package history
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// stores returns every store that runs in process, empty.
+func stores(t *testing.T) map[string]Store {
+	t.Helper()
+
+	sqlite, err := NewSQLiteStore("file:" + filepath.Join(t.TempDir(), "sessions.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = sqlite.Close() })
+
+	return map[string]Store{
+		"memory": NewMemoryStore(0),
+		"sqlite": sqlite,
+	}
+}
+
+var t0 = time.Date(2024, 3, 1, 12, 0, 0, 250_000_000, time.UTC)
+
+// sessions are saved as they end, which is not the order they were
+// matched in.
+var sessions = []*Record{
+	NewRecord("never-connected", "c", "a", SourcePool, t0.Add(10*time.Second), time.Time{}, t0.Add(20*time.Second), "ack_timeout"),
+	NewRecord("short", "b", "c", SourceInvite, t0.Add(30*time.Second), t0.Add(31*time.Second), t0.Add(40*time.Second), "disconnected"),
+	NewRecord("long", "a", "b", SourcePool, t0, t0.Add(2*time.Second), t0.Add(time.Minute), "disconnected"),
+}
+
+func TestFind(t *testing.T) {
+	tests := []struct {
+		name  string
+		query Query
+		want  []string
+	}{
+		{"all, most recently matched first", Query{}, []string{"short", "never-connected", "long"}},
+		{"either side", Query{UID: "a"}, []string{"never-connected", "long"}},
+		{"unknown uId", Query{UID: "z"}, nil},
+		{"since", Query{Since: t0.Add(10 * time.Second)}, []string{"short", "never-connected"}},
+		{"since after all", Query{Since: t0.Add(time.Hour)}, nil},
+		{"since and uId", Query{UID: "b", Since: t0.Add(time.Second)}, []string{"short"}},
+		{"limit", Query{Limit: 2}, []string{"short", "never-connected"}},
+		{"limit and uId", Query{UID: "a", Limit: 1}, []string{"never-connected"}},
+	}
+
+	for name, store := range stores(t) {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			for _, r := range sessions {
+				if err := store.Save(ctx, r); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			for _, tt := range tests {
+				t.Run(tt.name, func(t *testing.T) {
+					found, err := store.Find(ctx, tt.query)
+					if err != nil {
+						t.Fatal(err)
+					}
+					var got []string
+					for _, r := range found {
+						got = append(got, r.SessionID)
+					}
+					if len(got) != len(tt.want) {
+						t.Fatalf("found %v, want %v", got, tt.want)
+					}
+					for i := range got {
+						if got[i] != tt.want[i] {
+							t.Fatalf("found %v, want %v", got, tt.want)
+						}
+					}
+				})
+			}
+		})
+	}
+}
+
+func TestFindRecordFields(t *testing.T) {
+	for name, store := range stores(t) {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			for _, r := range sessions {
+				if err := store.Save(ctx, r); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			found, err := store.Find(ctx, Query{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			byID := make(map[string]*Record)
+			for _, r := range found {
+				byID[r.SessionID] = r
+			}
+
+			for _, want := range sessions {
+				got := byID[want.SessionID]
+				if got == nil {
+					t.Fatalf("%s not found", want.SessionID)
+				}
+				if got.OffererID != want.OffererID || got.AnswererID != want.AnswererID ||
+					got.Source != want.Source || got.EndReason != want.EndReason {
+					t.Errorf("%s: got %+v, want %+v", want.SessionID, got, want)
+				}
+				if !got.MatchedAt.Equal(want.MatchedAt) || !got.EndedAt.Equal(want.EndedAt) {
+					t.Errorf("%s: times %s-%s, want %s-%s", want.SessionID, got.MatchedAt, got.EndedAt, want.MatchedAt, want.EndedAt)
+				}
+				if got.TimeToConnectedMs != want.TimeToConnectedMs || got.DurationMs != want.DurationMs {
+					t.Errorf("%s: connected after %dms for %dms, want %dms for %dms", want.SessionID,
+						got.TimeToConnectedMs, got.DurationMs, want.TimeToConnectedMs, want.DurationMs)
+				}
+				switch {
+				case want.ConnectedAt == nil && got.ConnectedAt != nil:
+					t.Errorf("%s: connected at %s, want never", want.SessionID, got.ConnectedAt)
+				case want.ConnectedAt != nil && (got.ConnectedAt == nil || !got.ConnectedAt.Equal(*want.ConnectedAt)):
+					t.Errorf("%s: connected at %v, want %s", want.SessionID, got.ConnectedAt, want.ConnectedAt)
+				}
+			}
+
+			never := byID["never-connected"]
+			if never.ConnectedAt != nil || never.TimeToConnectedMs != -1 || never.DurationMs != 0 {
+				t.Errorf("session that never connected: %+v", never)
+			}
+		})
+	}
+}
+
+func TestMemoryStoreLimit(t *testing.T) {
+	store := NewMemoryStore(2)
+	ctx := context.Background()
+	for _, r := range sessions {
+		if err := store.Save(ctx, r); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	found, err := store.Find(ctx, Query{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(found) != 2 || found[0].SessionID != "short" || found[1].SessionID != "long" {
+		t.Fatalf("kept %d records, want the last two saved", len(found))
+	}
+}
@@ -5,10 +5,20 @@ import (
 	"log"
 	"net/http"
 	"os"
+	"strconv"
+	"time"
 
 	"github.com/gin-gonic/gin"
+	"github.com/saifwork/socket-service/auth"
+	"github.com/saifwork/socket-service/blocks"
+	"github.com/saifwork/socket-service/certs"
 	"github.com/saifwork/socket-service/configs"
+	"github.com/saifwork/socket-service/geo"
+	"github.com/saifwork/socket-service/history"
+	"github.com/saifwork/socket-service/metrics"
+	"github.com/saifwork/socket-service/responses"
 	"github.com/saifwork/socket-service/socket"
+	"github.com/saifwork/socket-service/turn"
 )
 
 func main() {
@@ -20,7 +30,53 @@ func main() {
 	r := gin.New()
 
 	// Initialize Hub
-	hub := socket.NewHub()
+	hub := socket.NewHub(config)
+
+	// Record ended sessions
+	sessionStore, err := history.Open(config)
+	if err != nil {
+		log.Fatalf("Fail to open the session store: %s", err)
+	}
+	defer sessionStore.Close()
+	hub.SetSessionStore(sessionStore)
+
+	// Keep the users each user blocked
+	blockStore, err := blocks.Open(config)
+	if err != nil {
+		log.Fatalf("Fail to open the block store: %s", err)
+	}
+	defer blockStore.Close()
+	hub.SetBlockStore(blockStore)
+
+	// Locate clients that don't report where they are
+	if config.GeoIPFile != "" {
+		locator, err := geo.OpenLocator(config.GeoIPFile)
+		if err != nil {
+			log.Fatalf("Fail to open the GeoIP database: %s", err)
+		}
+		defer locator.Close()
+		hub.SetLocator(locator)
+	}
+
+	// Authenticate clients with their tokens, which carry their tier
+	if config.AuthEnabled() {
+		verifier, err := auth.NewVerifier(config)
+		if err != nil {
+			log.Fatalf("Fail to set up token verification: %s", err)
+		}
+		hub.SetVerifier(verifier)
+	}
+
+	// Start the embedded TURN server, only usable by paired clients
+	if config.TURNEnabled {
+		turnServer, err := turn.NewServer(config, hub.Paired)
+		if err != nil {
+			log.Fatalf("Fail to start the TURN server: %s", err)
+		}
+		defer turnServer.Close()
+		hub.SetTURNServer(turnServer)
+	}
+
 	go hub.Run()
 
 	// Enable CORS middleware
@@ -29,21 +85,117 @@ func main() {
 	// Setup routes
 	r.GET("/health", Healthcheck)
 	r.GET("/ws", func(c *gin.Context) {
-		hub.SetContext(c)
 		socket.ServeWebsockets(hub, c.Writer, c.Request)
 	})
 
 	// Initializing the client pairing bot
 	go hub.PairWaitingClients()
 
+	// Load the certificate when the service terminates TLS itself
+	var reloader *certs.Reloader
+	if config.TLSEnabled() {
+		var err error
+		reloader, err = certs.NewReloader(config.TLSCertFile, config.TLSKeyFile)
+		if err != nil {
+			log.Fatalf("Fail to load the TLS certificate: %s", err)
+		}
+		go reloader.Watch(config.TLSReloadInterval)
+	}
+
+	if config.AdminPort != "" {
+		go serveAdmin(config, hub, sessionStore, reloader)
+	}
+
 	p := config.ServicePort
 	h := config.ServiceHost
-	log.Printf("Serving at %s\n", fmt.Sprintf("%s:%s", h, p))
-	if err := r.Run(fmt.Sprintf("%s:%s", h, p)); err != nil {
+	srv := &http.Server{
+		Addr:    fmt.Sprintf("%s:%s", h, p),
+		Handler: r,
+	}
+
+	if reloader != nil {
+		srv.TLSConfig = reloader.ServerConfig(nil)
+		log.Printf("Serving TLS at %s\n", srv.Addr)
+		if err := srv.ListenAndServeTLS("", ""); err != nil {
+			log.Fatalf("Fail to start the server on %s:%s ", h, p)
+		}
+		return
+	}
+
+	log.Printf("Serving at %s\n", srv.Addr)
+	if err := srv.ListenAndServe(); err != nil {
 		log.Fatalf("Fail to start the server on %s:%s ", h, p)
 	}
 }
 
+// serveAdmin runs the admin endpoints on their own port. When a client CA is
+// configured the endpoints are only reachable with a client certificate
+// signed by it. The call history names who talked to whom, so it is only
+// served then.
+func serveAdmin(config *configs.Config, hub *socket.Hub, sessionStore history.Store, reloader *certs.Reloader) {
+	srv := &http.Server{
+		Addr: fmt.Sprintf("%s:%s", config.ServiceHost, config.AdminPort),
+	}
+
+	if config.AdminClientCAFile != "" {
+		if reloader == nil {
+			log.Fatalf("ADMIN_CLIENT_CA_FILE requires TLS_CERT_FILE and TLS_KEY_FILE")
+		}
+		pool, err := certs.LoadCertPool(config.AdminClientCAFile)
+		if err != nil {
+			log.Fatalf("Fail to load the admin client CA: %s", err)
+		}
+		srv.TLSConfig = reloader.ServerConfig(pool)
+	} else if reloader != nil {
+		srv.TLSConfig = reloader.ServerConfig(nil)
+	}
+
+	r := gin.New()
+	r.GET("/health", Healthcheck)
+	r.GET("/admin/stats", func(c *gin.Context) {
+		c.JSON(http.StatusOK, hub.Stats())
+	})
+	r.GET("/admin/metrics", func(c *gin.Context) {
+		c.JSON(http.StatusOK, metrics.Snapshot())
+	})
+	if config.AdminClientCAFile != "" {
+		r.GET("/admin/sessions", func(c *gin.Context) {
+			q := history.Query{UID: c.Query("uId")}
+			q.Limit, _ = strconv.Atoi(c.Query("limit"))
+			if since := c.Query("since"); since != "" {
+				var err error
+				if q.Since, err = time.Parse(time.RFC3339, since); err != nil {
+					c.JSON(http.StatusBadRequest, responses.NewErrorResponse(http.StatusBadRequest, "since must be an RFC 3339 time", nil))
+					return
+				}
+			}
+
+			records, err := sessionStore.Find(c.Request.Context(), q)
+			if err != nil {
+				log.Printf("Failed to query session records: %s", err)
+				c.JSON(http.StatusInternalServerError, responses.NewErrorResponse(http.StatusInternalServerError, "failed to query session records", nil))
+				return
+			}
+			c.JSON(http.StatusOK, responses.NewSuccessResponse(records))
+		})
+	} else {
+		log.Printf("Not serving /admin/sessions: it requires ADMIN_CLIENT_CA_FILE")
+	}
+	srv.Handler = r
+
+	var err error
+	if srv.TLSConfig != nil {
+		log.Printf("Serving admin TLS at %s\n", srv.Addr)
+		err = srv.ListenAndServeTLS("", "")
+	} else {
+		log.Printf("Serving admin at %s\n", srv.Addr)
+		err = srv.ListenAndServe()
+	}
+	if err != nil {
+		log.Fatalf("Fail to start the admin server on %s: %s", srv.Addr, err)
+	}
+}
+
 func Healthcheck(c *gin.Context) {
 	version := os.Getenv("VERSION")
 	if version == "" {
@@ -0,0 +1,78 @@
+package metrics
+
+import (
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+var (
+	mu       sync.RWMutex
+	counters = make(map[string]*int64)
+)
+
+// Inc increments the counter with the given name and label pairs, e.g.
+// Inc("messages_dropped", "class", "presence").
+func Inc(name string, labels ...string) {
+	Add(name, 1, labels...)
+}
+
+// Add adds delta to the counter with the given name and label pairs.
+func Add(name string, delta int64, labels ...string) {
+	key := Key(name, labels...)
+
+	mu.RLock()
+	c, ok := counters[key]
+	mu.RUnlock()
+
+	if !ok {
+		mu.Lock()
+		if c, ok = counters[key]; !ok {
+			c = new(int64)
+			counters[key] = c
+		}
+		mu.Unlock()
+	}
+
+	atomic.AddInt64(c, delta)
+}
+
+// Get returns the current value of a counter.
+func Get(name string, labels ...string) int64 {
+	mu.RLock()
+	defer mu.RUnlock()
+
+	if c, ok := counters[Key(name, labels...)]; ok {
+		return atomic.LoadInt64(c)
+	}
+	return 0
+}
+
+// Snapshot returns the current value of every counter.
+func Snapshot() map[string]int64 {
+	mu.RLock()
+	defer mu.RUnlock()
+
+	snapshot := make(map[string]int64, len(counters))
+	for key, c := range counters {
+		snapshot[key] = atomic.LoadInt64(c)
+	}
+	return snapshot
+}
+
+// Key formats a counter name with its labels as name{k1="v1",k2="v2"},
+// with the labels sorted by key.
+func Key(name string, labels ...string) string {
+	if len(labels) < 2 {
+		return name
+	}
+
+	pairs := make([]string, 0, len(labels)/2)
+	for i := 0; i+1 < len(labels); i += 2 {
+		pairs = append(pairs, labels[i]+`="`+labels[i+1]+`"`)
+	}
+	sort.Strings(pairs)
+
+	return name + "{" + strings.Join(pairs, ",") + "}"
+}
@@ -0,0 +1,40 @@
+package sdp
+
+import "strings"
+
+// Candidate types, from the typ field of a candidate line.
+const (
+	CandidateHost  = "host"
+	CandidateSrflx = "srflx"
+	CandidatePrflx = "prflx"
+	CandidateRelay = "relay"
+)
+
+// CandidateType returns the type of a candidate line, with or without the
+// a= prefix, or "" when it has none.
+func CandidateType(candidate string) string {
+	// candidate:<foundation> <component> <transport> <priority> <address> <port> typ <type> ...
+	fields := strings.Fields(candidate)
+	for i := 6; i+1 < len(fields); i++ {
+		if fields[i] == "typ" {
+			return fields[i+1]
+		}
+	}
+	return ""
+}
+
+// MaskRelatedAddress replaces the related address and port of a candidate
+// line, which for srflx and relay candidates is the private address they
+// were gathered from, the way browsers do when they hide local addresses.
+func MaskRelatedAddress(candidate string) string {
+	fields := strings.Fields(candidate)
+	for i := 6; i+1 < len(fields); i++ {
+		switch fields[i] {
+		case "raddr":
+			fields[i+1] = "0.0.0.0"
+		case "rport":
+			fields[i+1] = "0"
+		}
+	}
+	return strings.Join(fields, " ")
+}
@@ -0,0 +1,53 @@
+package sdp
+
+import "testing"
+
+func TestCandidateType(t *testing.T) {
+	tests := []struct {
+		candidate string
+		want      string
+	}{
+		{"a=candidate:842163049 1 udp 2122260223 192.168.1.23 54320 typ host generation 0", CandidateHost},
+		{"candidate:842163049 1 udp 2122260223 192.168.1.23 54320 typ host generation 0", CandidateHost},
+		{"candidate:1510613869 1 tcp 1518280447 192.168.1.23 9 typ host tcptype active", CandidateHost},
+		{"candidate:3520934471 1 udp 1686052607 203.0.113.5 54321 typ srflx raddr 192.168.1.23 rport 54320", CandidateSrflx},
+		{"candidate:1 1 udp 1845501695 203.0.113.5 54321 typ prflx raddr 0.0.0.0 rport 0", CandidatePrflx},
+		{"candidate:1937418375 1 udp 41885439 198.51.100.7 61002 typ relay raddr 203.0.113.5 rport 54321", CandidateRelay},
+		{"candidate:0 1 UDP 2122252543 a3c1f0e2-8b1d-4c7e-9f3a-2b6d5e4c3a21.local 50000 typ host", CandidateHost},
+		{"candidate:842163049 1 udp 2122260223 192.168.1.23 54320", ""},
+		{"candidate:842163049 1 udp 2122260223 192.168.1.23 54320 typ", ""},
+		{"", ""},
+	}
+
+	for _, tt := range tests {
+		if got := CandidateType(tt.candidate); got != tt.want {
+			t.Errorf("CandidateType(%q) = %q, want %q", tt.candidate, got, tt.want)
+		}
+	}
+}
+
+func TestMaskRelatedAddress(t *testing.T) {
+	tests := []struct {
+		candidate string
+		want      string
+	}{
+		{
+			"a=candidate:3520934471 1 udp 1686052607 203.0.113.5 54321 typ srflx raddr 192.168.1.23 rport 54320 generation 0",
+			"a=candidate:3520934471 1 udp 1686052607 203.0.113.5 54321 typ srflx raddr 0.0.0.0 rport 0 generation 0",
+		},
+		{
+			"candidate:1937418375 1 udp 41885439 198.51.100.7 61002 typ relay raddr 203.0.113.5 rport 54321",
+			"candidate:1937418375 1 udp 41885439 198.51.100.7 61002 typ relay raddr 0.0.0.0 rport 0",
+		},
+		{
+			"a=candidate:842163049 1 udp 2122260223 192.168.1.23 54320 typ host generation 0",
+			"a=candidate:842163049 1 udp 2122260223 192.168.1.23 54320 typ host generation 0",
+		},
+	}
+
+	for _, tt := range tests {
+		if got := MaskRelatedAddress(tt.candidate); got != tt.want {
+			t.Errorf("MaskRelatedAddress(%q) = %q, want %q", tt.candidate, got, tt.want)
+		}
+	}
+}
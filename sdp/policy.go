@@ -0,0 +1,200 @@
+package sdp
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+var (
+	ErrDataChannelForbidden = errors.New("data channels are not allowed")
+	ErrVideoForbidden       = errors.New("video is not allowed")
+	ErrNoCodecs             = errors.New("no allowed codec left")
+)
+
+// Policy is what the server enforces on the SDP of offers and answers.
+type Policy struct {
+	// Codec names, such as "VP8" or "opus", removed from every media
+	// section. When KeepCodecs is set, only those codecs are kept instead.
+	// Retransmission (rtx) formats follow the codec they belong to.
+	StripCodecs []string
+	KeepCodecs  []string
+
+	// Cap on the b=AS and b=TIAS bandwidth of audio and video sections, in
+	// kbps. Zero leaves bandwidth alone.
+	MaxBandwidth int
+
+	ForbidDataChannels bool
+	ForbidVideo        bool
+
+	// Remove host candidates, which carry the private addresses of the
+	// client, and mask the related addresses of the other candidates.
+	StripHostCandidates bool
+
+	// Like StripHostCandidates, but keep only relay candidates, so no
+	// address of the client shows at all.
+	RelayOnly bool
+}
+
+// Apply parses the SDP, enforces the policy on it and returns the rewritten
+// SDP. Invalid SDPs and SDPs the policy forbids are rejected with an error.
+func (p *Policy) Apply(raw string) (string, error) {
+	s, err := Parse(raw)
+	if err != nil {
+		return "", err
+	}
+
+	for _, m := range s.Media {
+		switch m.Type {
+		case "application":
+			if p.ForbidDataChannels && m.Port != "0" {
+				return "", ErrDataChannelForbidden
+			}
+		case "video":
+			if p.ForbidVideo && m.Port != "0" {
+				return "", ErrVideoForbidden
+			}
+		}
+
+		if m.Type == "audio" || m.Type == "video" {
+			if err := p.filterCodecs(m); err != nil {
+				return "", err
+			}
+			p.capBandwidth(m)
+		}
+
+		if p.StripHostCandidates || p.RelayOnly {
+			m.filterLines(func(line string) bool {
+				if !strings.HasPrefix(line, "a=candidate:") {
+					return true
+				}
+				if p.RelayOnly {
+					return CandidateType(line) == CandidateRelay
+				}
+				return CandidateType(line) != CandidateHost
+			})
+			for i, line := range m.Lines {
+				switch {
+				case strings.HasPrefix(line, "a=candidate:"):
+					m.Lines[i] = MaskRelatedAddress(line)
+				case strings.HasPrefix(line, "c=IN "):
+					// The default candidate's address, ICE doesn't use it
+					m.Lines[i] = "c=IN IP4 0.0.0.0"
+				}
+			}
+		}
+	}
+
+	return s.String(), nil
+}
+
+// filterCodecs removes the payload types of codecs the policy doesn't
+// allow, along with their rtpmap, fmtp and rtcp-fb lines.
+func (p *Policy) filterCodecs(m *Media) error {
+	if len(p.StripCodecs) == 0 && len(p.KeepCodecs) == 0 {
+		return nil
+	}
+
+	codecs := m.Codecs()
+	removed := make(map[string]bool)
+	for pt, name := range codecs {
+		if !strings.EqualFold(name, "rtx") && !p.allows(name) {
+			removed[pt] = true
+		}
+	}
+
+	// rtx formats go with the payload type they retransmit
+	for _, line := range m.Lines {
+		if pt, ok := payloadType(line, "fmtp"); ok && strings.EqualFold(codecs[pt], "rtx") {
+			if apt, found := strings.CutPrefix(fmtpParams(line), "apt="); found && removed[apt] {
+				removed[pt] = true
+			}
+		}
+	}
+
+	if len(removed) == 0 {
+		return nil
+	}
+
+	var formats []string
+	for _, pt := range m.Formats {
+		if !removed[pt] {
+			formats = append(formats, pt)
+		}
+	}
+	if len(formats) == 0 {
+		if m.Port != "0" {
+			return fmt.Errorf("%w for %s", ErrNoCodecs, m.Type)
+		}
+		// An m= line needs a format, a rejected section negotiates
+		// nothing anyway
+		return nil
+	}
+	m.Formats = formats
+
+	m.filterLines(func(line string) bool {
+		for _, attr := range []string{"rtpmap", "fmtp", "rtcp-fb"} {
+			if pt, ok := payloadType(line, attr); ok {
+				return !removed[pt]
+			}
+		}
+		return true
+	})
+	return nil
+}
+
+func (p *Policy) allows(codec string) bool {
+	if len(p.KeepCodecs) > 0 {
+		return containsFold(p.KeepCodecs, codec)
+	}
+	return !containsFold(p.StripCodecs, codec)
+}
+
+// capBandwidth lowers the b=AS and b=TIAS lines of the section to the
+// policy's cap, or adds a b=AS line where the section has neither.
+func (p *Policy) capBandwidth(m *Media) {
+	if p.MaxBandwidth <= 0 {
+		return
+	}
+
+	// b=AS is in kbps, b=TIAS in bps
+	limits := map[string]int{"b=AS:": p.MaxBandwidth, "b=TIAS:": p.MaxBandwidth * 1000}
+	found := false
+	for i, line := range m.Lines {
+		for prefix, limit := range limits {
+			if value, ok := strings.CutPrefix(line, prefix); ok {
+				found = true
+				if bw, err := strconv.Atoi(value); err != nil || bw > limit {
+					m.Lines[i] = prefix + strconv.Itoa(limit)
+				}
+			}
+		}
+	}
+	if found {
+		return
+	}
+
+	// b= lines go after the i= and c= lines of the section
+	at := 0
+	for at < len(m.Lines) && (m.Lines[at][0] == 'i' || m.Lines[at][0] == 'c') {
+		at++
+	}
+	capped := "b=AS:" + strconv.Itoa(p.MaxBandwidth)
+	m.Lines = append(m.Lines[:at], append([]string{capped}, m.Lines[at:]...)...)
+}
+
+// fmtpParams returns the parameters of an a=fmtp:<pt> <params> line.
+func fmtpParams(line string) string {
+	_, params, _ := strings.Cut(line, " ")
+	return params
+}
+
+func containsFold(list []string, s string) bool {
+	for _, v := range list {
+		if strings.EqualFold(v, s) {
+			return true
+		}
+	}
+	return false
+}
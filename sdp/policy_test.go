@@ -0,0 +1,265 @@
+package sdp
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// apply applies the policy to a browser offer and parses the result.
+func apply(t *testing.T, p *Policy, raw string) *Session {
+	t.Helper()
+
+	out, err := p.Apply(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return mustParse(t, out)
+}
+
+// linesOf returns the lines of the section that start with prefix.
+func linesOf(m *Media, prefix string) []string {
+	var lines []string
+	for _, line := range m.Lines {
+		if strings.HasPrefix(line, prefix) {
+			lines = append(lines, line)
+		}
+	}
+	return lines
+}
+
+// checkPayloadTypes fails unless the section lists the payload types, and
+// its rtpmap, fmtp and rtcp-fb lines refer to no other.
+func checkPayloadTypes(t *testing.T, m *Media, want []string) {
+	t.Helper()
+
+	if !reflect.DeepEqual(m.Formats, want) {
+		t.Errorf("%s formats %v, want %v", m.Type, m.Formats, want)
+	}
+
+	listed := make(map[string]bool)
+	for _, pt := range want {
+		listed[pt] = true
+	}
+	for _, line := range m.Lines {
+		for _, attr := range []string{"rtpmap", "fmtp", "rtcp-fb"} {
+			if pt, ok := payloadType(line, attr); ok && !listed[pt] {
+				t.Errorf("%s line of a removed payload type kept: %s", m.Type, line)
+			}
+		}
+		if apt, ok := strings.CutPrefix(fmtpParams(line), "apt="); ok && !listed[apt] {
+			t.Errorf("rtx of a removed payload type kept: %s", line)
+		}
+	}
+}
+
+func TestApplyCodecs(t *testing.T) {
+	tests := []struct {
+		name   string
+		file   string
+		policy Policy
+		audio  []string
+		video  []string
+	}{
+		{
+			name:   "chrome strip VP8",
+			file:   "chrome_offer.sdp",
+			policy: Policy{StripCodecs: []string{"vp8"}},
+			audio:  []string{"111", "63", "9", "0", "8", "13", "110", "126"},
+			video:  []string{"98", "99", "100", "101", "45", "46", "35", "36", "114", "115", "116"},
+		},
+		{
+			name:   "chrome strip H264 and red",
+			file:   "chrome_offer.sdp",
+			policy: Policy{StripCodecs: []string{"H264", "red"}},
+			audio:  []string{"111", "9", "0", "8", "13", "110", "126"},
+			video:  []string{"96", "97", "98", "99", "45", "46", "116"},
+		},
+		{
+			name:   "chrome keep opus and VP8",
+			file:   "chrome_offer.sdp",
+			policy: Policy{KeepCodecs: []string{"opus", "VP8"}},
+			audio:  []string{"111"},
+			video:  []string{"96", "97"},
+		},
+		{
+			name:   "chrome keep wins over strip",
+			file:   "chrome_offer.sdp",
+			policy: Policy{StripCodecs: []string{"VP8"}, KeepCodecs: []string{"opus", "VP8"}},
+			audio:  []string{"111"},
+			video:  []string{"96", "97"},
+		},
+		{
+			name:   "firefox strip VP8",
+			file:   "firefox_offer.sdp",
+			policy: Policy{StripCodecs: []string{"VP8"}},
+			audio:  []string{"109", "9", "0", "8", "101"},
+			video:  []string{"121", "125", "126", "127", "97", "98"},
+		},
+		{
+			name:   "firefox keep opus and H264",
+			file:   "firefox_offer.sdp",
+			policy: Policy{KeepCodecs: []string{"opus", "H264"}},
+			audio:  []string{"109"},
+			video:  []string{"126", "127", "97", "98"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := apply(t, &tt.policy, readSDP(t, tt.file))
+			checkPayloadTypes(t, section(t, s, "audio"), tt.audio)
+			checkPayloadTypes(t, section(t, s, "video"), tt.video)
+
+			// Lines that aren't about a payload type stay
+			if got := linesOf(section(t, s, "video"), "a=ssrc-group:FID"); len(got) != 1 {
+				t.Errorf("ssrc-group lost: %v", got)
+			}
+		})
+	}
+}
+
+func TestApplyNoCodecLeft(t *testing.T) {
+	for _, file := range browserOffers {
+		t.Run(file, func(t *testing.T) {
+			p := &Policy{KeepCodecs: []string{"opus"}}
+			if _, err := p.Apply(readSDP(t, file)); !errors.Is(err, ErrNoCodecs) {
+				t.Fatalf("got %v, want %v", err, ErrNoCodecs)
+			}
+
+			// Unless the section is rejected anyway, which is left as is
+			raw := strings.Replace(readSDP(t, file), "m=video 54321 ", "m=video 0 ", 1)
+			raw = strings.Replace(raw, "m=video 9 ", "m=video 0 ", 1)
+			want := section(t, mustParse(t, raw), "video").Formats
+			s := apply(t, p, raw)
+			if got := section(t, s, "video").Formats; !reflect.DeepEqual(got, want) {
+				t.Fatalf("video formats %v, want %v", got, want)
+			}
+		})
+	}
+}
+
+func TestApplyBandwidth(t *testing.T) {
+	offer := readSDP(t, "firefox_offer.sdp")
+	withVideoLine := func(line string) string {
+		return strings.Replace(offer, "m=video 9 UDP/TLS/RTP/SAVPF 120 124 121 125 126 127 97 98\r\nc=IN IP4 0.0.0.0\r\n",
+			"m=video 9 UDP/TLS/RTP/SAVPF 120 124 121 125 126 127 97 98\r\nc=IN IP4 0.0.0.0\r\n"+line+"\r\n", 1)
+	}
+
+	tests := []struct {
+		name  string
+		raw   string
+		video []string
+	}{
+		{"added when missing", offer, []string{"b=AS:500"}},
+		{"AS lowered", withVideoLine("b=AS:2000"), []string{"b=AS:500"}},
+		{"AS under the cap kept", withVideoLine("b=AS:300"), []string{"b=AS:300"}},
+		{"AS not a number", withVideoLine("b=AS:lots"), []string{"b=AS:500"}},
+		{"TIAS lowered", withVideoLine("b=TIAS:2000000"), []string{"b=TIAS:500000"}},
+		{"TIAS under the cap kept", withVideoLine("b=TIAS:128000"), []string{"b=TIAS:128000"}},
+		{"both lowered", withVideoLine("b=AS:2000\r\nb=TIAS:2000000"), []string{"b=AS:500", "b=TIAS:500000"}},
+	}
+
+	p := &Policy{MaxBandwidth: 500}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := apply(t, p, tt.raw)
+
+			video := section(t, s, "video")
+			if got := linesOf(video, "b="); !reflect.DeepEqual(got, tt.video) {
+				t.Errorf("video bandwidth %v, want %v", got, tt.video)
+			}
+			if video.Lines[0] != "c=IN IP4 0.0.0.0" {
+				t.Errorf("bandwidth went before the c= line: %v", video.Lines[:2])
+			}
+			if got := linesOf(section(t, s, "audio"), "b="); !reflect.DeepEqual(got, []string{"b=AS:500"}) {
+				t.Errorf("audio bandwidth %v, want b=AS:500", got)
+			}
+		})
+	}
+
+	// Data channels aren't capped
+	s := apply(t, p, readSDP(t, "chrome_offer.sdp"))
+	if got := linesOf(section(t, s, "application"), "b="); len(got) != 0 {
+		t.Errorf("application section capped: %v", got)
+	}
+}
+
+func TestApplyForbidden(t *testing.T) {
+	chrome := readSDP(t, "chrome_offer.sdp")
+	firefox := readSDP(t, "firefox_offer.sdp")
+
+	tests := []struct {
+		name   string
+		raw    string
+		policy Policy
+		want   error
+	}{
+		{"data channel", chrome, Policy{ForbidDataChannels: true}, ErrDataChannelForbidden},
+		{"rejected data channel", strings.Replace(chrome, "m=application 54321 ", "m=application 0 ", 1), Policy{ForbidDataChannels: true}, nil},
+		{"no data channel", firefox, Policy{ForbidDataChannels: true}, nil},
+		{"video", firefox, Policy{ForbidVideo: true}, ErrVideoForbidden},
+		{"rejected video", strings.Replace(firefox, "m=video 9 ", "m=video 0 ", 1), Policy{ForbidVideo: true}, nil},
+		{"malformed", strings.Replace(firefox, "a=rtpmap:109 opus/48000/2", "a=rtpmap:109 opus", 1), Policy{}, ErrInvalid},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := tt.policy.Apply(tt.raw)
+			if tt.want == nil && err != nil {
+				t.Fatalf("rejected: %s", err)
+			}
+			if !errors.Is(err, tt.want) {
+				t.Fatalf("got %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestApplyCandidates(t *testing.T) {
+	tests := []struct {
+		name   string
+		policy Policy
+		types  []string
+	}{
+		{"strip host", Policy{StripHostCandidates: true}, []string{CandidateSrflx, CandidateRelay}},
+		{"relay only", Policy{RelayOnly: true}, []string{CandidateRelay}},
+		{"relay only wins", Policy{StripHostCandidates: true, RelayOnly: true}, []string{CandidateRelay}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := apply(t, &tt.policy, readSDP(t, "chrome_offer.sdp"))
+
+			for _, m := range s.Media {
+				var types []string
+				for _, line := range linesOf(m, "a=candidate:") {
+					types = append(types, CandidateType(line))
+					if strings.Contains(line, "192.168.1.23") {
+						t.Errorf("private address left in %s", line)
+					}
+					if strings.Contains(line, " raddr ") && !strings.Contains(line, " raddr 0.0.0.0 rport 0") {
+						t.Errorf("related address not masked in %s", line)
+					}
+				}
+				if !reflect.DeepEqual(types, tt.types) {
+					t.Errorf("%s candidates %v, want %v", m.Type, types, tt.types)
+				}
+				if got := linesOf(m, "c="); !reflect.DeepEqual(got, []string{"c=IN IP4 0.0.0.0"}) {
+					t.Errorf("%s connection %v, want 0.0.0.0", m.Type, got)
+				}
+			}
+		})
+	}
+
+	// Without a candidate policy, candidates are left alone
+	raw := readSDP(t, "chrome_offer.sdp")
+	out, err := (&Policy{}).Apply(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out != raw {
+		t.Error("SDP changed by an empty policy")
+	}
+}
@@ -0,0 +1,195 @@
+// Package sdp parses session descriptions just enough to inspect and
+// rewrite them: the session level lines and the media sections, each with
+// its m= line and attributes. Everything else is kept as is.
+package sdp
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+var ErrInvalid = errors.New("invalid SDP")
+
+// Session is a parsed session description.
+type Session struct {
+	// Lines before the first m= line
+	Lines []string
+	Media []*Media
+}
+
+// Media is a media section, from its m= line to the next one.
+type Media struct {
+	Type    string // audio, video or application
+	Port    string
+	Proto   string
+	Formats []string
+
+	// Lines after the m= line
+	Lines []string
+}
+
+// Parse parses a session description. It checks the overall structure and
+// the m= and rtpmap lines, which are the ones policies act on.
+func Parse(raw string) (*Session, error) {
+	raw = strings.TrimRight(raw, "\r\n")
+	if raw == "" {
+		return nil, fmt.Errorf("%w: empty", ErrInvalid)
+	}
+
+	s := &Session{}
+	var media *Media
+	for i, line := range strings.Split(raw, "\n") {
+		line = strings.TrimSuffix(line, "\r")
+		if len(line) < 2 || line[1] != '=' || line[0] < 'a' || line[0] > 'z' {
+			return nil, fmt.Errorf("%w: malformed line %d", ErrInvalid, i+1)
+		}
+
+		if i == 0 && line != "v=0" {
+			return nil, fmt.Errorf("%w: must start with v=0", ErrInvalid)
+		}
+
+		switch {
+		case line[0] == 'm':
+			m, err := parseMediaLine(line)
+			if err != nil {
+				return nil, err
+			}
+			media = m
+			s.Media = append(s.Media, m)
+
+		case media != nil:
+			if strings.HasPrefix(line, "a=rtpmap:") {
+				if _, _, ok := parseRtpmap(line); !ok {
+					return nil, fmt.Errorf("%w: malformed rtpmap in %s section", ErrInvalid, media.Type)
+				}
+			}
+			media.Lines = append(media.Lines, line)
+
+		default:
+			s.Lines = append(s.Lines, line)
+		}
+	}
+
+	if !s.hasLine("o=") || !s.hasLine("s=") {
+		return nil, fmt.Errorf("%w: missing o= or s= line", ErrInvalid)
+	}
+
+	return s, nil
+}
+
+// String serializes the session description with CRLF line endings.
+func (s *Session) String() string {
+	var b strings.Builder
+	for _, line := range s.Lines {
+		b.WriteString(line + "\r\n")
+	}
+	for _, m := range s.Media {
+		b.WriteString(m.mediaLine() + "\r\n")
+		for _, line := range m.Lines {
+			b.WriteString(line + "\r\n")
+		}
+	}
+	return b.String()
+}
+
+func (s *Session) hasLine(prefix string) bool {
+	for _, line := range s.Lines {
+		if strings.HasPrefix(line, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// Attribute returns the value of the first a=<name>: attribute of the media
+// section.
+func (m *Media) Attribute(name string) (string, bool) {
+	prefix := "a=" + name + ":"
+	for _, line := range m.Lines {
+		if strings.HasPrefix(line, prefix) {
+			return line[len(prefix):], true
+		}
+	}
+	return "", false
+}
+
+// Codecs returns the codec name of every payload type with an rtpmap.
+func (m *Media) Codecs() map[string]string {
+	codecs := make(map[string]string)
+	for _, line := range m.Lines {
+		if pt, name, ok := parseRtpmap(line); ok {
+			codecs[pt] = name
+		}
+	}
+	return codecs
+}
+
+// filterLines keeps the lines for which keep returns true.
+func (m *Media) filterLines(keep func(string) bool) {
+	lines := m.Lines[:0]
+	for _, line := range m.Lines {
+		if keep(line) {
+			lines = append(lines, line)
+		}
+	}
+	m.Lines = lines
+}
+
+func (m *Media) mediaLine() string {
+	return strings.Join(append([]string{"m=" + m.Type, m.Port, m.Proto}, m.Formats...), " ")
+}
+
+// parseMediaLine parses "m=<media> <port> <proto> <fmt> ...".
+func parseMediaLine(line string) (*Media, error) {
+	fields := strings.Fields(line[2:])
+	if len(fields) < 4 {
+		return nil, fmt.Errorf("%w: malformed m= line %q", ErrInvalid, line)
+	}
+
+	port, _, _ := strings.Cut(fields[1], "/")
+	if _, err := strconv.ParseUint(port, 10, 16); err != nil {
+		return nil, fmt.Errorf("%w: bad port in m= line %q", ErrInvalid, line)
+	}
+
+	return &Media{
+		Type:    fields[0],
+		Port:    fields[1],
+		Proto:   fields[2],
+		Formats: fields[3:],
+	}, nil
+}
+
+// parseRtpmap parses "a=rtpmap:<pt> <name>/<clock rate>[/<channels>]" and
+// returns the payload type and the codec name.
+func parseRtpmap(line string) (pt, name string, ok bool) {
+	value, found := strings.CutPrefix(line, "a=rtpmap:")
+	if !found {
+		return "", "", false
+	}
+
+	pt, encoding, found := strings.Cut(value, " ")
+	if !found {
+		return "", "", false
+	}
+	if _, err := strconv.ParseUint(pt, 10, 8); err != nil {
+		return "", "", false
+	}
+
+	name, _, found = strings.Cut(encoding, "/")
+	if !found || name == "" {
+		return "", "", false
+	}
+	return pt, name, true
+}
+
+// payloadType returns the payload type an a=<attr>:<pt> ... line refers to.
+func payloadType(line, attr string) (string, bool) {
+	value, found := strings.CutPrefix(line, "a="+attr+":")
+	if !found {
+		return "", false
+	}
+	pt, _, _ := strings.Cut(value, " ")
+	return pt, true
+}
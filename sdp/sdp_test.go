@@ -0,0 +1,150 @@
+package sdp
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// browserOffers are offers as sent by the browsers, with CRLF line endings.
+var browserOffers = []string{"chrome_offer.sdp", "firefox_offer.sdp"}
+
+func readSDP(t *testing.T, name string) string {
+	t.Helper()
+
+	data, err := os.ReadFile(filepath.Join("testdata", name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+func mustParse(t *testing.T, raw string) *Session {
+	t.Helper()
+
+	s, err := Parse(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+// section returns the first media section of the type.
+func section(t *testing.T, s *Session, typ string) *Media {
+	t.Helper()
+
+	for _, m := range s.Media {
+		if m.Type == typ {
+			return m
+		}
+	}
+	t.Fatalf("no %s section", typ)
+	return nil
+}
+
+func TestParseBrowserOffers(t *testing.T) {
+	tests := []struct {
+		file  string
+		media []string
+		audio []string
+		video []string
+		codec map[string]string
+	}{
+		{
+			file:  "chrome_offer.sdp",
+			media: []string{"audio", "video", "application"},
+			audio: []string{"111", "63", "9", "0", "8", "13", "110", "126"},
+			video: []string{"96", "97", "98", "99", "100", "101", "45", "46", "35", "36", "114", "115", "116"},
+			codec: map[string]string{"111": "opus", "96": "VP8", "97": "rtx", "45": "AV1", "116": "ulpfec"},
+		},
+		{
+			file:  "firefox_offer.sdp",
+			media: []string{"audio", "video"},
+			audio: []string{"109", "9", "0", "8", "101"},
+			video: []string{"120", "124", "121", "125", "126", "127", "97", "98"},
+			codec: map[string]string{"109": "opus", "120": "VP8", "124": "rtx", "126": "H264"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.file, func(t *testing.T) {
+			raw := readSDP(t, tt.file)
+			s := mustParse(t, raw)
+
+			var media []string
+			for _, m := range s.Media {
+				media = append(media, m.Type)
+			}
+			if !reflect.DeepEqual(media, tt.media) {
+				t.Fatalf("media %v, want %v", media, tt.media)
+			}
+			if got := section(t, s, "audio").Formats; !reflect.DeepEqual(got, tt.audio) {
+				t.Errorf("audio formats %v, want %v", got, tt.audio)
+			}
+			if got := section(t, s, "video").Formats; !reflect.DeepEqual(got, tt.video) {
+				t.Errorf("video formats %v, want %v", got, tt.video)
+			}
+
+			codecs := section(t, s, "audio").Codecs()
+			for pt, name := range section(t, s, "video").Codecs() {
+				codecs[pt] = name
+			}
+			for pt, want := range tt.codec {
+				if codecs[pt] != want {
+					t.Errorf("payload type %s is %q, want %q", pt, codecs[pt], want)
+				}
+			}
+
+			if got := s.String(); got != raw {
+				t.Errorf("SDP changed by a round trip:\n%s", got)
+			}
+		})
+	}
+}
+
+func TestParseAcceptsLF(t *testing.T) {
+	raw := strings.ReplaceAll(readSDP(t, "firefox_offer.sdp"), "\r\n", "\n")
+	if got := mustParse(t, raw).String(); got != readSDP(t, "firefox_offer.sdp") {
+		t.Errorf("LF SDP not serialized with CRLF:\n%s", got)
+	}
+}
+
+func TestParseRejectsMalformed(t *testing.T) {
+	valid := "v=0\r\no=- 1 2 IN IP4 127.0.0.1\r\ns=-\r\nt=0 0\r\n" +
+		"m=audio 9 UDP/TLS/RTP/SAVPF 111\r\nc=IN IP4 0.0.0.0\r\na=rtpmap:111 opus/48000/2\r\n"
+	mustParse(t, valid)
+
+	tests := []struct {
+		name string
+		raw  string
+	}{
+		{"empty", ""},
+		{"blank lines", "\r\n\r\n"},
+		{"not SDP", "hello world"},
+		{"no version first", strings.Replace(valid, "v=0\r\n", "", 1) + "v=0\r\n"},
+		{"wrong version", strings.Replace(valid, "v=0", "v=1", 1)},
+		{"line without =", strings.Replace(valid, "t=0 0", "t 0 0", 1)},
+		{"uppercase type", strings.Replace(valid, "t=0 0", "T=0 0", 1)},
+		{"empty line", strings.Replace(valid, "t=0 0\r\n", "t=0 0\r\n\r\n", 1)},
+		{"missing origin", strings.Replace(valid, "o=- 1 2 IN IP4 127.0.0.1\r\n", "", 1)},
+		{"missing session name", strings.Replace(valid, "s=-\r\n", "", 1)},
+		{"short media line", strings.Replace(valid, "m=audio 9 UDP/TLS/RTP/SAVPF 111", "m=audio 9 UDP/TLS/RTP/SAVPF", 1)},
+		{"bad port", strings.Replace(valid, "m=audio 9 ", "m=audio 70000 ", 1)},
+		{"port not a number", strings.Replace(valid, "m=audio 9 ", "m=audio nine ", 1)},
+		{"rtpmap without codec", strings.Replace(valid, "opus/48000/2", "", 1)},
+		{"rtpmap without clock rate", strings.Replace(valid, "opus/48000/2", "opus", 1)},
+		{"rtpmap bad payload type", strings.Replace(valid, "a=rtpmap:111", "a=rtpmap:x11", 1)},
+		{"rtpmap payload type too big", strings.Replace(valid, "a=rtpmap:111", "a=rtpmap:256", 1)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := Parse(tt.raw); !errors.Is(err, ErrInvalid) {
+				t.Fatalf("got %v, want %v", err, ErrInvalid)
+			}
+		})
+	}
+}
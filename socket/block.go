@@ -0,0 +1,153 @@
+package socket
+
+import (
+	"context"
+	"errors"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/saifwork/socket-service/blocks"
+	"github.com/saifwork/socket-service/metrics"
+)
+
+// How long loading or saving blocks may take.
+const blockStoreTimeout = 5 * time.Second
+
+var (
+	ErrBlockSelf       = errors.New("cannot block yourself")
+	ErrBlockNotPartner = errors.New("only current and recent partners can be blocked")
+)
+
+type BlockRequest struct {
+	ID string `json:"uId"`
+}
+
+// blockCache holds the blocks of the connected uIds, in both directions,
+// so the matcher can check them without going to the store. A uId may have
+// several clients at once, e.g. one reconnecting while the old one waits
+// out its resume grace, so its blocks are kept until every load of them
+// was forgotten.
+type blockCache struct {
+	mu      sync.Mutex
+	blocked map[string]map[string]bool
+	refs    map[string]int
+}
+
+func newBlockCache() *blockCache {
+	return &blockCache{
+		blocked: make(map[string]map[string]bool),
+		refs:    make(map[string]int),
+	}
+}
+
+// load adds the blocks of uid read from the store. Each load must be
+// matched by a forget.
+func (b *blockCache) load(uid string, blocked []string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	set, ok := b.blocked[uid]
+	if !ok {
+		set = make(map[string]bool, len(blocked))
+		b.blocked[uid] = set
+	}
+	for _, other := range blocked {
+		set[other] = true
+	}
+	b.refs[uid]++
+}
+
+// add records a block between two uIds, for those of them that are loaded.
+func (b *blockCache) add(uid, other string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if set, ok := b.blocked[uid]; ok {
+		set[other] = true
+	}
+	if set, ok := b.blocked[other]; ok {
+		set[uid] = true
+	}
+}
+
+// forget releases a load of the blocks of uid, dropping them once no client
+// of the uId needs them anymore.
+func (b *blockCache) forget(uid string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.refs[uid]--; b.refs[uid] <= 0 {
+		delete(b.refs, uid)
+		delete(b.blocked, uid)
+	}
+}
+
+// has reports whether either uId blocked the other.
+func (b *blockCache) has(uid, other string) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.blocked[uid][other] || b.blocked[other][uid]
+}
+
+// SetBlockStore makes blocks persist in store. Must be called before Run.
+func (h *Hub) SetBlockStore(store blocks.Store) {
+	h.blockStore = store
+}
+
+// LoadBlocks loads the blocks of a connecting uId, it must not be paired
+// before they are known. A connection that doesn't end up as a new client
+// must give them back with ReleaseBlocks.
+func (h *Hub) LoadBlocks(ctx context.Context, uid string) error {
+	if h.blockStore == nil {
+		h.blocks.load(uid, nil)
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, blockStoreTimeout)
+	defer cancel()
+
+	blocked, err := h.blockStore.Blocked(ctx, uid)
+	if err != nil {
+		return err
+	}
+	h.blocks.load(uid, blocked)
+	return nil
+}
+
+// ReleaseBlocks gives back the blocks loaded for a connection that didn't
+// end up as a new client.
+func (h *Hub) ReleaseBlocks(uid string) {
+	h.blocks.forget(uid)
+}
+
+// BlockUser makes the client block the given uId for good. The two are
+// never paired again. Only the current or last partner, or one the client
+// was recently paired with, can be blocked.
+func (h *Hub) BlockUser(client *Client, uid string) error {
+	if uid == client.ID {
+		return ErrBlockSelf
+	}
+
+	h.mu.Lock()
+	partner := client.lastPartnerID
+	h.mu.Unlock()
+	if uid != partner && !h.recent.has(client.ID, uid, time.Now()) {
+		return ErrBlockNotPartner
+	}
+
+	if h.blockStore != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), blockStoreTimeout)
+		defer cancel()
+
+		if err := h.blockStore.Block(ctx, client.ID, uid); err != nil {
+			return err
+		}
+	}
+	h.blocks.add(client.ID, uid)
+
+	metrics.Inc("users_blocked")
+	log.Printf("Client %s blocked %s", client.ID, uid)
+	return nil
+}
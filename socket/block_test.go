@@ -0,0 +1,40 @@
+package socket
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/saifwork/socket-service/configs"
+)
+
+// The partner of a call that just ended can be blocked whatever the recent
+// partner history keeps.
+func TestBlockLastPartner(t *testing.T) {
+	for _, history := range []int{0, 5} {
+		h := NewHub(&configs.Config{MatchAckTimeout: time.Minute, RecentPartnerHistory: history, RecentPartnerTTL: time.Minute})
+		a, b, c := newRoomClient(h, "a"), newRoomClient(h, "b"), newRoomClient(h, "c")
+		for _, client := range []*Client{a, b, c} {
+			if err := h.LoadBlocks(context.Background(), client.ID); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		h.mu.Lock()
+		s, _ := h.linkLocked(a, b, false)
+		s.established = true
+		h.unlinkLocked(s, EndDisconnected)
+		h.mu.Unlock()
+
+		if err := h.BlockUser(a, c.ID); !errors.Is(err, ErrBlockNotPartner) {
+			t.Fatalf("history %d: blocking a stranger got %v, want %v", history, err, ErrBlockNotPartner)
+		}
+		if err := h.BlockUser(a, b.ID); err != nil {
+			t.Fatalf("history %d: blocking the last partner: %s", history, err)
+		}
+		if !h.blocks.has(a.ID, b.ID) || !h.blocks.has(b.ID, a.ID) {
+			t.Fatalf("history %d: block not recorded", history)
+		}
+	}
+}
@@ -1,15 +1,24 @@
 package socket
 
 import (
+	"crypto/rand"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"net/http"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 
 	log "log"
 
 	"github.com/google/uuid"
 	"github.com/gorilla/websocket"
+	"github.com/saifwork/socket-service/geo"
+	"github.com/saifwork/socket-service/metrics"
 	"github.com/saifwork/socket-service/responses"
 	"github.com/saifwork/socket-service/types"
 )
@@ -24,8 +33,13 @@ const (
 	// Send pings to peer with this period. Must be less than pongWait.
 	pingPeriod = (pongWait * 9) / 10
 
-	// Maximum message size allowed from peer.
-	maxMessageSize = 2048
+	// Messages past the configured maximum size are rejected and reported
+	// to the peer. Past this many times the maximum, the connection is
+	// dropped instead of reading the rest of the message.
+	readLimitSlack = 4
+
+	// Number of outbound messages buffered per client.
+	sendBufferSize = 256
 )
 
 var (
@@ -33,9 +47,12 @@ var (
 // space   = []byte{' '}
 )
 
+var errMessageTooBig = errors.New("message too big")
+
 var upgrader = websocket.Upgrader{
 	ReadBufferSize:  1024,
 	WriteBufferSize: 1024,
+	Subprotocols:    subprotocols(),
 	CheckOrigin: func(r *http.Request) bool {
 		return true
 	},
@@ -46,35 +63,54 @@ type User struct {
 	Addr      string    `json:"addr"`      // Network address of the user (IP or WebSocket addr)
 	EnterAt   time.Time `json:"enterAt"`   // Timestamp when the user entered the waiting state
 	IsWaiting bool      `json:"isWaiting"` // Whether the user is in the waiting state for matchmaking
+	PartnerID string    `json:"partnerId"` // The uId of the user this one is paired with
+	SessionID string    `json:"sessionId"` // Identifier of the current pairing
+
+	// What the user told about itself and wants from a partner when it
+	// started searching, see StartChatRequest
+	Languages []string    `json:"languages"` // Primary language subtags spoken, e.g. "en"
+	Mode      string      `json:"mode"`      // Kind of chat: video, audio or text
+	Require   MatchFilter `json:"require"`   // Hard filters a partner must pass
+	Prefer    MatchFilter `json:"prefer"`    // Soft preferences, scoring partners
+
+	// Matchmaking tier, from the token the user connected with
+	Tier string `json:"tier"`
 }
 
 type ClientMessage struct {
 	Client  *Client
-	Message []byte
+	Message *MessageResponse
 }
 
+// MessageRequest is the envelope of every client request. The data field
+// is decoded separately, see Client.decodeData.
 type MessageRequest struct {
-	Action string          `json:"action"`
-	Data   json.RawMessage `json:"data"`
+	Action string `json:"action"`
 }
 
 type Offer struct {
-	ID       string `json:"uId"`  // UID or Peer ID
-	OfferSDP string `json:"sdp"`  // SDP sent by the frontend
-	Type     string `json:"type"` // Type should be "offer"
+	ID       string `json:"uId"`              // UID or Peer ID
+	OfferSDP string `json:"sdp"`              // SDP sent by the frontend
+	Type     string `json:"type"`             // Type should be "offer"
+	RoomID   string `json:"roomId,omitempty"` // Room both peers are in, for group calls
 }
 
 type Answer struct {
-	ID        string `json:"uId"`    // UID or Peer ID
-	AnswerSDP string `json:"answer"` // SDP sent by the frontend
-	Type      string `json:"type"`   // Type should be "offer"
+	ID        string `json:"uId"`              // UID or Peer ID
+	AnswerSDP string `json:"answer"`           // SDP sent by the frontend
+	Type      string `json:"type"`             // Type should be "offer"
+	RoomID    string `json:"roomId,omitempty"` // Room both peers are in, for group calls
 }
 
+// IceCandidate follows the RTCIceCandidateInit shape browsers produce with
+// RTCIceCandidate.toJSON(). An empty candidate marks the end of candidates.
 type IceCandidate struct {
-	ID            string `json:"uId"`
-	Candidate     string `json:"candidate"`
-	SdpMid        string `json:"sdpMid"`
-	SdpMLineIndex string `json:"sdpMLineIndex"`
+	ID               string  `json:"uId"`
+	Candidate        string  `json:"candidate"`
+	SdpMid           *string `json:"sdpMid"`
+	SdpMLineIndex    *uint16 `json:"sdpMLineIndex"`
+	UsernameFragment *string `json:"usernameFragment"`
+	RoomID           string  `json:"roomId,omitempty"`
 }
 
 type ClientDisconnect struct {
@@ -86,6 +122,19 @@ type MessageResponse struct {
 	Message interface{} `json:"message"`
 }
 
+// Connected is the payload of the connected message. The resume token lets
+// the client re-attach to its session after losing the socket.
+type Connected struct {
+	Connected   bool   `json:"connected"`
+	Resumed     bool   `json:"resumed"`
+	ResumeToken string `json:"resumeToken,omitempty"`
+	Batch       bool   `json:"batch"`
+
+	// "relay" when the client's addresses are kept private, in which case
+	// only relay candidates are forwarded to its peers
+	IceTransportPolicy string `json:"iceTransportPolicy"`
+}
+
 // Client is a middleman between the websocket connection and the hub.
 type Client struct {
 	// The hub handling the messages logic
@@ -94,8 +143,52 @@ type Client struct {
 	// The websocket connection.
 	conn *websocket.Conn
 
-	// Buffered channel of outbound messages.
-	send chan []byte
+	// Encoding negotiated for the connection.
+	codec Codec
+
+	// Whether the client asked for queued messages to be batched into a
+	// single frame.
+	batch bool
+
+	// Buffered channel of outbound messages, see Hub.deliver.
+	send       chan *MessageResponse
+	sendMu     sync.Mutex
+	sendClosed bool
+
+	// Messages held back while the send buffer is full, and the timer
+	// disconnecting the client when they aren't sent in time.
+	overflow      []*MessageResponse
+	overflowTimer *time.Timer
+
+	// Presence level the client is subscribed to.
+	presence string
+
+	// Whether the client asked for privacy mode, see Client.private.
+	privacy bool
+
+	// Where the client said it is when it started its search, or where
+	// GeoIP puts it.
+	location geo.Location
+
+	// Whether the client went back to the pool after a failed match, which
+	// puts it at the front.
+	requeued bool
+
+	// uId of the client it was last paired with, kept once the session
+	// ended so that it can still be blocked.
+	lastPartnerID string
+
+	// Set when the client was disconnected for not draining its buffer,
+	// cleared when it resumes on a new connection.
+	slow bool
+
+	// Token the client presents to resume its session on a new connection.
+	resumeToken string
+
+	// Whether the connection dropped and the client may still resume, and
+	// the timer removing it when the grace window runs out.
+	detached   bool
+	graceTimer *time.Timer
 
 	User
 }
@@ -108,25 +201,34 @@ type Client struct {
 func (c *Client) ReadPump() {
 	log.Println("INFO: inside ReadPump()")
 
+	// The connection is captured once, a resume may replace c.conn later
+	conn, codec := c.conn, c.codec
+
 	defer func() {
 		if c == nil || c.hub == nil {
 			return
 		}
-		c.hub.unregister <- c
-		if c.conn != nil {
-			_ = c.conn.Close()
+		c.hub.unregister <- &connRef{client: c, conn: conn}
+		if conn != nil {
+			_ = conn.Close()
 		}
 	}()
-	c.conn.SetReadLimit(maxMessageSize)
-	_ = c.conn.SetReadDeadline(time.Now().Add(pongWait))
+	maxMessageSize := c.hub.config.MaxMessageSize
+	conn.SetReadLimit(int64(maxMessageSize) * readLimitSlack)
+	_ = conn.SetReadDeadline(time.Now().Add(pongWait))
 
-	c.conn.SetPongHandler(func(string) error {
-		_ = c.conn.SetReadDeadline(time.Now().Add(pongWait))
+	conn.SetPongHandler(func(string) error {
+		_ = conn.SetReadDeadline(time.Now().Add(pongWait))
 		return nil
 	})
 
 	for {
-		_, message, err := c.conn.ReadMessage()
+		message, err := readMessage(conn, maxMessageSize)
+		if errors.Is(err, errMessageTooBig) {
+			log.Printf("Client %s sent a message over %d bytes", c.ID, maxMessageSize)
+			c.sendError(http.StatusRequestEntityTooLarge, fmt.Sprintf("message exceeds %d bytes", maxMessageSize))
+			continue
+		}
 		if err != nil {
 			if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseAbnormalClosure) {
 				log.Println(err)
@@ -136,7 +238,7 @@ func (c *Client) ReadPump() {
 
 		// Parse the message into the generic MessageRequest struct
 		var msgReq MessageRequest
-		if err := json.Unmarshal(message, &msgReq); err != nil {
+		if err := codec.Unmarshal(message, &msgReq); err != nil {
 			log.Println("Error parsing message:", err)
 			continue
 		}
@@ -144,8 +246,33 @@ func (c *Client) ReadPump() {
 		switch msgReq.Action {
 
 		case types.ActionStartChatReq:
+			var req StartChatRequest
+			if err := decodeData(codec, message, &req); err != nil {
+				log.Println("Error parsing start chat:", err)
+				c.sendError(http.StatusBadRequest, "invalid start chat request")
+				continue
+			}
+
+			location, err := c.hub.locate(c, &req)
+			if err != nil {
+				c.sendError(http.StatusBadRequest, err.Error())
+				continue
+			}
+			if err := req.normalize(); err != nil {
+				c.sendError(http.StatusBadRequest, err.Error())
+				continue
+			}
+			if err := c.hub.checkFilters(c.Tier, &req); err != nil {
+				c.sendError(http.StatusForbidden, err.Error())
+				continue
+			}
+
 			// Set the client as waiting
-			c.IsWaiting = true
+			if err := c.hub.StartSearch(c, location, &req); err != nil {
+				c.sendError(http.StatusConflict, err.Error())
+				continue
+			}
+			metrics.Inc("queue_joined", "tier", c.Tier)
 			log.Printf("Client %s is now waiting for a match", c.ID)
 
 			// Acknowledge the client that they are in the waiting state
@@ -153,69 +280,196 @@ func (c *Client) ReadPump() {
 				Action:  types.ActionStartChatAck,
 				Message: responses.NewSuccessResponse("waiting for a match"),
 			}
-			msg, err := json.Marshal(mr)
-			if err != nil {
-				log.Printf("Failed to marshal start chat ack: %s", err)
+			c.hub.deliver(c, mr)
+
+		case types.ActionMatchAck:
+			var ack MatchAck
+			if err := decodeData(codec, message, &ack); err != nil || ack.SessionID == "" {
+				log.Println("Error parsing match ack:", err)
+				c.sendError(http.StatusBadRequest, "sessionId is required")
 				continue
 			}
-			c.send <- msg
+
+			if err := c.hub.AcceptMatch(c, ack.SessionID); err != nil {
+				c.sendError(http.StatusNotFound, err.Error())
+				continue
+			}
+
+		case types.ActionStopChatReq:
+			if err := c.hub.StopSearch(c); err != nil {
+				c.sendError(http.StatusConflict, err.Error())
+				continue
+			}
+			c.sendMessage(types.ActionStopChatAck, "stopped searching")
 
 		case types.ActionOfferRes:
 			var offer Offer
-			if err := json.Unmarshal(msgReq.Data, &offer); err != nil {
+			if err := decodeData(codec, message, &offer); err != nil {
 				log.Println("Error parsing offer:", err)
 				continue
 			}
 			log.Printf("Received offer: %s", offer)
 
+			if !c.canRelayInRoom(offer.RoomID, offer.ID) {
+				continue
+			}
+
+			// Nothing to relay, the pending offers are just forgotten
+			if offer.Type == sdpTypeRollback {
+				c.hub.rollbackFrom(c, offer.ID)
+				continue
+			}
+
+			sanitized, ok := c.inspectSDP(offer.OfferSDP)
+			if !ok {
+				continue
+			}
+
+			// Resolve offers crossing each other within the session
+			if !c.hub.offerFrom(c, offer.ID) {
+				continue
+			}
+
 			res := map[string]string{
 				"uId":  c.ID,
-				"sdp":  offer.OfferSDP,
+				"sdp":  sanitized,
 				"type": offer.Type,
 			}
+			if offer.RoomID != "" {
+				res["roomId"] = offer.RoomID
+			}
 
 			// Call the refactored function
 			c.handleMessageResponse(types.ActionAnswerReq, res, offer.ID)
 
 		case types.ActionAnswerRes:
 			var answer Answer
-			if err := json.Unmarshal(msgReq.Data, &answer); err != nil {
+			if err := decodeData(codec, message, &answer); err != nil {
 				log.Println("Error parsing answer:", err)
 				continue
 			}
 			log.Printf("Received answer: %s", answer)
 
+			if !c.canRelayInRoom(answer.RoomID, answer.ID) {
+				continue
+			}
+
+			sanitized, ok := c.inspectSDP(answer.AnswerSDP)
+			if !ok {
+				continue
+			}
+
 			res := map[string]string{
 				"uId":    c.ID,
-				"answer": answer.AnswerSDP,
+				"answer": sanitized,
 				"type":   answer.Type,
 			}
+			if answer.RoomID != "" {
+				res["roomId"] = answer.RoomID
+			}
 
 			// Call the refactored function
 			c.handleMessageResponse(types.ActionAnswerRec, res, answer.ID)
+			c.hub.answerFrom(c, answer.ID)
 
 		case types.ActionIceCandidateRes:
 			var iceCandidate IceCandidate
-			if err := json.Unmarshal(msgReq.Data, &iceCandidate); err != nil {
+			if err := decodeData(codec, message, &iceCandidate); err != nil {
 				log.Println("Error parsing ICE candidate:", err)
+				c.sendError(http.StatusBadRequest, "invalid ICE candidate: "+err.Error())
+				continue
+			}
+			if err := iceCandidate.Validate(); err != nil {
+				log.Println("Invalid ICE candidate:", err)
+				c.sendError(http.StatusBadRequest, "invalid ICE candidate: "+err.Error())
 				continue
 			}
 			log.Printf("Received ICE candidate: %s", iceCandidate.Candidate)
 
-			res := map[string]string{
-				"uId":    c.ID,
-				"candidate": iceCandidate.Candidate,
-				"sdpMid":   iceCandidate.SdpMid,
-				"sdpMLineIndex": iceCandidate.SdpMLineIndex,
+			if !c.canRelayInRoom(iceCandidate.RoomID, iceCandidate.ID) {
+				continue
+			}
+
+			// Keep the client's addresses from its peer in privacy mode
+			if !c.allowCandidate(&iceCandidate) {
+				continue
 			}
 
+			target := iceCandidate.ID
+			iceCandidate.ID = c.ID
+
 			// Call the refactored function
-			c.handleMessageResponse(types.ActionIceCandidateRec, res, iceCandidate.ID)
+			c.handleMessageResponse(types.ActionIceCandidateRec, &iceCandidate, target)
+
+		case types.ActionRenegotiateRes:
+			var reneg Renegotiation
+			if err := decodeData(codec, message, &reneg); err != nil {
+				log.Println("Error parsing renegotiation:", err)
+				continue
+			}
+
+			if !c.hub.inSession(c, reneg.ID, true) {
+				c.sendError(http.StatusConflict, "no active call with "+reneg.ID)
+				continue
+			}
+
+			// An abandoned renegotiation
+			if reneg.Type == sdpTypeRollback {
+				c.hub.rollbackFrom(c, reneg.ID)
+				continue
+			}
+
+			sanitized, ok := c.inspectSDP(reneg.SDP)
+			if !ok {
+				continue
+			}
+			reneg.SDP = sanitized
+
+			// Renegotiation offers can collide like the first one
+			if !c.hub.offerFrom(c, reneg.ID) {
+				continue
+			}
+
+			log.Printf("Client %s renegotiates with %s (ICE restart: %t)", c.ID, reneg.ID, reneg.IceRestart)
+			target := reneg.ID
+			reneg.ID = c.ID
+			c.handleMessageResponse(types.ActionRenegotiateReq, &reneg, target)
+
+		case types.ActionIceRestartRes:
+			var req IceRestartRequest
+			if err := decodeData(codec, message, &req); err != nil {
+				log.Println("Error parsing ICE restart request:", err)
+				continue
+			}
+
+			if !c.hub.inSession(c, req.ID, true) {
+				c.sendError(http.StatusConflict, "no active call with "+req.ID)
+				continue
+			}
+
+			log.Printf("Client %s requests an ICE restart from %s", c.ID, req.ID)
+			c.handleMessageResponse(types.ActionIceRestartReq, &IceRestartRequest{ID: c.ID}, req.ID)
+
+		case types.ActionEndOfCandidatesRes:
+			var eoc EndOfCandidates
+			if err := decodeData(codec, message, &eoc); err != nil {
+				log.Println("Error parsing end of candidates:", err)
+				continue
+			}
+
+			if !c.hub.inSession(c, eoc.ID, false) {
+				c.sendError(http.StatusConflict, "not paired with "+eoc.ID)
+				continue
+			}
+
+			target := eoc.ID
+			eoc.ID = c.ID
+			c.handleMessageResponse(types.ActionEndOfCandidatesRec, &eoc, target)
 
 		case types.ActionDisConnected:
 
 			// var clientDisconnect ClientDisconnect
-			// if err := json.Unmarshal(msgReq.Data, &clientDisconnect); err != nil {
+			// if err := decodeData(codec, message, &clientDisconnect); err != nil {
 			// 	log.Println("Error parsing ICE candidate:", err)
 			// 	continue
 			// }
@@ -229,14 +483,114 @@ func (c *Client) ReadPump() {
 				return
 			}
 
-			if _, ok := c.hub.clients[client]; ok {
-				delete(c.hub.clients, client)
-				close(client.send)
-			}
+			_, ok := c.hub.clients[client]
+			delete(c.hub.clients, client)
 			c.hub.mu.Unlock()
+			if ok {
+				client.closeSend()
+			}
+			c.hub.removed(client)
 
 			log.Printf("Client Disconnect: %s", c.ID)
 
+		case types.ActionJoinRoom:
+			var req RoomRequest
+			if err := decodeData(codec, message, &req); err != nil {
+				log.Println("Error parsing join room:", err)
+				c.sendError(http.StatusBadRequest, "roomId is required")
+				continue
+			}
+
+			members, err := c.hub.JoinRoom(c, req.ID)
+			if errors.Is(err, ErrInvalidRoomID) {
+				c.sendError(http.StatusBadRequest, err.Error())
+				continue
+			}
+			if err != nil {
+				c.sendError(http.StatusConflict, err.Error())
+				continue
+			}
+			c.sendMessage(types.ActionJoinRoomAck, members)
+
+		case types.ActionLeaveRoom:
+			var req RoomRequest
+			if err := decodeData(codec, message, &req); err != nil || req.ID == "" {
+				log.Println("Error parsing leave room:", err)
+				c.sendError(http.StatusBadRequest, "roomId is required")
+				continue
+			}
+
+			if err := c.hub.LeaveRoom(c, req.ID); err != nil {
+				c.sendError(http.StatusNotFound, err.Error())
+				continue
+			}
+			c.sendMessage(types.ActionLeaveRoomAck, &RoomRequest{ID: req.ID})
+
+		case types.ActionPresenceSubscribe:
+			var sub PresenceSubscription
+			if err := decodeData(codec, message, &sub); err != nil || !c.hub.SetPresence(c, sub.Level) {
+				log.Println("Error parsing presence subscription:", err)
+				c.sendError(http.StatusBadRequest, "level must be one of none, count or stats")
+				continue
+			}
+			c.hub.sendPresence(c)
+
+		case types.ActionCreateInvite:
+			invite, err := c.hub.CreateInvite(c)
+			if errors.Is(err, ErrTooManyInvites) {
+				c.sendError(http.StatusTooManyRequests, err.Error())
+				continue
+			}
+			if err != nil {
+				log.Printf("Failed to create invite: %s", err)
+				c.sendError(http.StatusInternalServerError, "could not create invite")
+				continue
+			}
+			c.sendMessage(types.ActionInviteCreated, invite)
+
+		case types.ActionJoinInvite:
+			var req InviteRequest
+			if err := decodeData(codec, message, &req); err != nil || req.Code == "" {
+				log.Println("Error parsing join invite:", err)
+				c.sendError(http.StatusBadRequest, "code is required")
+				continue
+			}
+
+			if err := c.hub.JoinInvite(c, strings.ToUpper(req.Code)); err != nil {
+				code := http.StatusNotFound
+				switch {
+				case errors.Is(err, ErrInviteOwn):
+					code = http.StatusBadRequest
+				case errors.Is(err, ErrInCall):
+					code = http.StatusConflict
+				}
+				c.sendError(code, err.Error())
+				continue
+			}
+
+		case types.ActionBlockUser:
+			var req BlockRequest
+			if err := decodeData(codec, message, &req); err != nil || req.ID == "" {
+				log.Println("Error parsing block user:", err)
+				c.sendError(http.StatusBadRequest, "uId is required")
+				continue
+			}
+
+			if err := c.hub.BlockUser(c, req.ID); err != nil {
+				code := http.StatusInternalServerError
+				switch {
+				case errors.Is(err, ErrBlockSelf):
+					code = http.StatusBadRequest
+				case errors.Is(err, ErrBlockNotPartner):
+					code = http.StatusForbidden
+				default:
+					log.Printf("Failed to block %s for %s: %s", req.ID, c.ID, err)
+				}
+				c.sendError(code, err.Error())
+				continue
+			}
+			c.sendMessage(types.ActionBlockUserAck, &BlockRequest{ID: req.ID})
+
 		default:
 			log.Println("Unknown action:", msgReq.Action)
 		}
@@ -251,16 +605,25 @@ func (c *Client) ReadPump() {
 // executing all writes from this goroutine.
 func (c *Client) WritePump() {
 
+	// The connection and channel are captured once, a resume replaces both
+	conn, send := c.conn, c.send
+	w := &frameWriter{
+		conn:      conn,
+		codec:     c.codec,
+		threshold: c.hub.config.CompressionThreshold,
+		batch:     c.batch,
+	}
+
 	ticker := time.NewTicker(pingPeriod)
 	defer func() {
 		ticker.Stop()
-		_ = c.conn.Close()
+		_ = conn.Close()
 	}()
 
 	for {
 		select {
-		case message, ok := <-c.send:
-			_ = c.conn.SetWriteDeadline(time.Now().Add(writeWait))
+		case message, ok := <-send:
+			_ = conn.SetWriteDeadline(time.Now().Add(writeWait))
 			if !ok {
 				// The hub closed the channel.
 				messageStr := fmt.Sprintf("[%s] INFO: Client closed the channel - Total clients %d", time.Now(), len(c.hub.clients))
@@ -268,34 +631,49 @@ func (c *Client) WritePump() {
 				return
 			}
 
-			// Send the first message
-			err := c.conn.WriteMessage(websocket.TextMessage, message)
-			if err != nil {
-				log.Println("Error sending message: ", err)
-				return
+			// Coalesce the messages already queued behind the first one
+			batch := []*MessageResponse{message}
+			for n := len(send); n > 0 && len(batch) < maxBatchSize; n-- {
+				next, ok := <-send
+				if !ok {
+					break
+				}
+				batch = append(batch, next)
 			}
 
-			// Send remaining messages one by one
-			for i := 0; i < len(c.send); i++ {
-				nextMessage := <-c.send
-				err = c.conn.WriteMessage(websocket.TextMessage, nextMessage)
-				if err != nil {
-					log.Println("Error sending message: ", err)
-					return
-				}
+			if err := w.write(batch); err != nil {
+				log.Println("Error sending message: ", err)
+
+				// Let the hub unregister the client without waiting for
+				// the read side to notice
+				_ = conn.Close()
+				c.hub.unregister <- &connRef{client: c, conn: conn}
+				return
 			}
+			c.refill()
 
 		case <-ticker.C:
-			if err := c.conn.SetWriteDeadline(time.Now().Add(writeWait)); err != nil {
+			if err := conn.SetWriteDeadline(time.Now().Add(writeWait)); err != nil {
 				return
 			}
-			if err := c.conn.WriteMessage(websocket.PingMessage, nil); err != nil {
+			if err := conn.WriteMessage(websocket.PingMessage, nil); err != nil {
 				return
 			}
 		}
 	}
 }
 
+// rejectRequest replies to a websocket request that can't be upgraded with
+// an error response. It writes to the request's own writer, as concurrent
+// handshakes share nothing else.
+func rejectRequest(w http.ResponseWriter, status int, message string) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(responses.NewErrorResponse(status, message, nil)); err != nil {
+		log.Printf("Failed to write the error response: %s", err)
+	}
+}
+
 // ServeWebsockets handles websocket requests from the peer.
 func ServeWebsockets(hub *Hub, w http.ResponseWriter, r *http.Request) {
 
@@ -303,29 +681,76 @@ func ServeWebsockets(hub *Hub, w http.ResponseWriter, r *http.Request) {
 	uId := r.URL.Query().Get("uId")
 	if uId == "" {
 		log.Printf("[%s] uId not provided in the request", time.Now())
-		hub.ctx.AbortWithStatusJSON(http.StatusBadRequest, responses.NewErrorResponse(http.StatusBadRequest, "uId is required", nil))
+		rejectRequest(w, http.StatusBadRequest, "uId is required")
 		return
 	}
 
-	conn, err := upgrader.Upgrade(w, r, nil)
+	// Check the token of the client, which gives its matchmaking tier
+	tier, status, err := hub.authenticate(r, uId)
+	if err != nil {
+		log.Printf("[%s] Rejected the token of %s: %s", time.Now(), uId, err)
+		rejectRequest(w, status, err.Error())
+		return
+	}
+
+	// The client can't be matched before its blocks are known
+	if err := hub.LoadBlocks(r.Context(), uId); err != nil {
+		log.Printf("[%s] Failed to load the blocks of %s: %s", time.Now(), uId, err)
+		rejectRequest(w, http.StatusServiceUnavailable, "failed to load user data")
+		return
+	}
+
+	u := upgrader
+	u.EnableCompression = hub.config.CompressionEnabled
+	conn, err := u.Upgrade(w, r, nil)
 	if err != nil {
 		log.Printf("[%s] Error on serving the websocket: %s", time.Now(), err.Error())
+		hub.ReleaseBlocks(uId)
 		if conn != nil {
 			_ = conn.Close()
 		}
 
-		if hub != nil {
-
-			hub.ctx.AbortWithStatusJSON(http.StatusBadRequest, responses.NewErrorResponse(http.StatusBadRequest, "Bad socket request %s", err.Error()))
-		}
-
+		// The upgrader already replied with the error
 		return
 	}
 
 	log.Printf("INFO: Req conn upgraded")
 
+	// Pick the encoding the client negotiated, whether it wants queued
+	// messages batched into one frame and whether it wants privacy mode
+	codec := codecFor(conn.Subprotocol())
+	batch, _ := strconv.ParseBool(r.URL.Query().Get("batch"))
+	privacy, _ := strconv.ParseBool(r.URL.Query().Get("privacy"))
+
+	if hub.config.CompressionEnabled {
+		if err := conn.SetCompressionLevel(hub.config.CompressionLevel); err != nil {
+			log.Printf("Invalid compression level %d: %s", hub.config.CompressionLevel, err)
+		}
+	}
+
+	// Re-attach to an existing session when the client presents its token
+	if token := r.URL.Query().Get("resumeToken"); token != "" {
+		if client, resumeToken := hub.resume(uId, token, conn, codec, batch); client != nil {
+			client.sendMessage(types.ActionConnected, &Connected{
+				Connected:          true,
+				Resumed:            true,
+				ResumeToken:        resumeToken,
+				Batch:              batch,
+				IceTransportPolicy: client.iceTransportPolicy(),
+			})
+
+			// The resumed client already has its blocks
+			hub.ReleaseBlocks(uId)
+			return
+		}
+		log.Printf("[%s] INFO: No session to resume for %s, starting a new one", time.Now(), uId)
+	}
+
 	log.Printf("[%s] DEBUG: Creating the client", time.Now())
-	client := &Client{hub: hub, conn: conn, send: make(chan []byte, 256)}
+	client := &Client{hub: hub, conn: conn, codec: codec, batch: batch, privacy: privacy, send: make(chan *MessageResponse, sendBufferSize)}
+	client.presence = PresenceLevelCount
+	client.resumeToken = GenResumeToken()
+	client.Tier = tier
 
 	log.Printf("[%s] DEBUG: Generating the user id", time.Now())
 	if uId != "" {
@@ -346,8 +771,7 @@ func ServeWebsockets(hub *Hub, w http.ResponseWriter, r *http.Request) {
 	log.Printf("[%s] DEBUG: Registering the client", time.Now())
 	client.hub.register <- client
 
-	// Logging the client info
-	log.Printf("[%s] INFO: Client info: %+v", time.Now(), client)
+	log.Printf("[%s] INFO: Client %s registered from %s", time.Now(), client.ID, client.Addr)
 
 	// Allow collection of memory referenced by the caller by doing all work in
 	// new goroutines.
@@ -358,49 +782,135 @@ func ServeWebsockets(hub *Hub, w http.ResponseWriter, r *http.Request) {
 	go client.ReadPump()
 
 	mr := &MessageResponse{
-		Action:  types.ActionConnected,
-		Message: responses.NewSuccessResponse(true),
-	}
-
-	msg, err := json.Marshal(mr)
-	if err != nil {
-		log.Printf("Failed to marshal user data: %s", err)
-
-		hub.ctx.AbortWithStatusJSON(http.StatusBadRequest, responses.NewErrorResponse(http.StatusBadRequest, err.Error(), nil))
-		return
+		Action: types.ActionConnected,
+		Message: responses.NewSuccessResponse(&Connected{
+			Connected:          true,
+			ResumeToken:        client.resumeToken,
+			Batch:              batch,
+			IceTransportPolicy: client.iceTransportPolicy(),
+		}),
 	}
 
-	client.send <- msg
+	hub.deliver(client, mr)
 }
 
 func (c *Client) handleMessageResponse(action string, obj interface{}, clientUID string) {
-	// Marshal the object into JSON
 	mr := &MessageResponse{
 		Action:  action,
 		Message: responses.NewSuccessResponse(obj),
 	}
 
-	msg, err := json.Marshal(mr)
-	if err != nil {
-		log.Printf("Failed to marshal user data: %s", err)
-		c.hub.ctx.AbortWithStatusJSON(http.StatusBadRequest, responses.NewErrorResponse(http.StatusBadRequest, err.Error(), nil))
-		return
-	}
-
 	// Find the remote client by UID
 	remoteClient := c.hub.GetWaitingClientByUID(clientUID)
 	if remoteClient != nil {
 		// Client with the specified UID and isWaiting == true was found
 		log.Printf("Found waiting client with UID: %s", remoteClient.ID)
 
-		remoteClient.send <- msg
+		c.hub.deliver(remoteClient, mr)
 	} else {
 		// Handle the case where no client was found
 		log.Println("No waiting client found with the given UID")
 	}
 }
 
+// sendMessage queues a success response with the given action and data.
+func (c *Client) sendMessage(action string, data interface{}) {
+	mr := &MessageResponse{
+		Action:  action,
+		Message: responses.NewSuccessResponse(data),
+	}
+
+	c.hub.deliver(c, mr)
+}
+
+// sendError queues an error response for a request the client made.
+func (c *Client) sendError(code int, message string) {
+	mr := &MessageResponse{
+		Action:  types.ActionError,
+		Message: responses.NewErrorResponse(code, message, nil),
+	}
+
+	c.hub.deliver(c, mr)
+}
+
+// canRelayInRoom checks that a signaling message addressed to a room is
+// between two of its members. Messages outside of a room are always
+// allowed.
+func (c *Client) canRelayInRoom(roomID, targetUID string) bool {
+	if roomID == "" {
+		return true
+	}
+	if !c.hub.InRoom(roomID, c.ID) || !c.hub.InRoom(roomID, targetUID) {
+		c.sendError(http.StatusForbidden, ErrNotRoomMember.Error())
+		return false
+	}
+	return true
+}
+
+// queueSend swaps the send channel for a fresh one and closes the old one,
+// which stops the current WritePump. Messages still pending are moved over
+// so they are flushed once the client resumes. Must be called with the hub
+// lock held.
+func (c *Client) queueSend() {
+	c.sendMu.Lock()
+	defer c.sendMu.Unlock()
+
+	if c.sendClosed {
+		return
+	}
+
+	old := c.send
+	c.send = make(chan *MessageResponse, sendBufferSize)
+drain:
+	for {
+		select {
+		case msg := <-old:
+			c.send <- msg
+		default:
+			break drain
+		}
+	}
+	close(old)
+}
+
+// decodeData decodes the data field of a request into v.
+func decodeData(codec Codec, message []byte, v interface{}) error {
+	return codec.Unmarshal(message, &dataEnvelope{Data: v})
+}
+
+// readMessage reads the next message from the connection. Messages larger
+// than maxSize are discarded and reported with errMessageTooBig, leaving
+// the connection usable.
+func readMessage(conn *websocket.Conn, maxSize int) ([]byte, error) {
+	_, r, err := conn.NextReader()
+	if err != nil {
+		return nil, err
+	}
+
+	message, err := io.ReadAll(io.LimitReader(r, int64(maxSize)+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(message) > maxSize {
+		if _, err := io.Copy(io.Discard, r); err != nil {
+			return nil, err
+		}
+		return nil, errMessageTooBig
+	}
+
+	return message, nil
+}
+
 // GenUserId generate a new custom user id
 func GenUserId() string {
 	return uuid.NewString()
 }
+
+// GenResumeToken generates a random token used to resume a session.
+func GenResumeToken() string {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return uuid.NewString()
+	}
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,57 @@
+package socket
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/saifwork/socket-service/configs"
+	"github.com/saifwork/socket-service/responses"
+)
+
+// Handshakes rejected at the same time each get their own error.
+func TestConcurrentRejectedHandshakes(t *testing.T) {
+	h := NewHub(&configs.Config{AuthRequired: true})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ServeWebsockets(h, w, r)
+	}))
+	defer srv.Close()
+
+	tests := []struct {
+		query  string
+		status int
+	}{
+		{"", http.StatusBadRequest},
+		{"?uId=a", http.StatusUnauthorized},
+		{"?uId=b&token=forged", http.StatusUnauthorized},
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 30; i++ {
+		tt := tests[i%len(tests)]
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			resp, err := http.Get(srv.URL + tt.query)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			defer resp.Body.Close()
+
+			var body responses.ResponseDto
+			if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+				t.Errorf("%q: %s", tt.query, err)
+				return
+			}
+			if resp.StatusCode != tt.status || body.Success || body.Error == nil || body.Error.Code != tt.status {
+				t.Errorf("%q: got %d %s, want %d", tt.query, resp.StatusCode, fmt.Sprint(body.Error), tt.status)
+			}
+		}()
+	}
+	wg.Wait()
+}
@@ -0,0 +1,98 @@
+package socket
+
+import (
+	"bytes"
+	"encoding/json"
+
+	"github.com/gorilla/websocket"
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+// Subprotocols a client can ask for in Sec-WebSocket-Protocol. Clients that
+// don't ask for one get JSON.
+const (
+	SubprotocolJSON    = "meengle.json.v1"
+	SubprotocolMsgpack = "meengle.msgpack.v1"
+)
+
+// Codec encodes and decodes the messages exchanged with a client, in the
+// format negotiated when the connection was upgraded.
+type Codec interface {
+	// Subprotocol is the Sec-WebSocket-Protocol name of the codec.
+	Subprotocol() string
+
+	// MessageType is the websocket frame type the codec writes.
+	MessageType() int
+
+	Marshal(v interface{}) ([]byte, error)
+	Unmarshal(data []byte, v interface{}) error
+}
+
+// codecs lists the supported codecs, in order of server preference.
+var codecs = []Codec{
+	jsonCodec{},
+	msgpackCodec{},
+}
+
+// codecFor returns the codec of a negotiated subprotocol, falling back to
+// JSON when none was negotiated.
+func codecFor(subprotocol string) Codec {
+	for _, codec := range codecs {
+		if codec.Subprotocol() == subprotocol {
+			return codec
+		}
+	}
+	return jsonCodec{}
+}
+
+func subprotocols() []string {
+	names := make([]string, 0, len(codecs))
+	for _, codec := range codecs {
+		names = append(names, codec.Subprotocol())
+	}
+	return names
+}
+
+// dataEnvelope decodes only the data field of a request, into the value
+// Data points to.
+type dataEnvelope struct {
+	Data interface{} `json:"data"`
+}
+
+type jsonCodec struct{}
+
+func (jsonCodec) Subprotocol() string { return SubprotocolJSON }
+
+func (jsonCodec) MessageType() int { return websocket.TextMessage }
+
+func (jsonCodec) Marshal(v interface{}) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+func (jsonCodec) Unmarshal(data []byte, v interface{}) error {
+	return json.Unmarshal(data, v)
+}
+
+// msgpackCodec uses the json struct tags, so every message type works with
+// both codecs without extra tags.
+type msgpackCodec struct{}
+
+func (msgpackCodec) Subprotocol() string { return SubprotocolMsgpack }
+
+func (msgpackCodec) MessageType() int { return websocket.BinaryMessage }
+
+func (msgpackCodec) Marshal(v interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	enc := msgpack.NewEncoder(&buf)
+	enc.SetCustomStructTag("json")
+	if err := enc.Encode(v); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (msgpackCodec) Unmarshal(data []byte, v interface{}) error {
+	dec := msgpack.NewDecoder(bytes.NewReader(data))
+	dec.SetCustomStructTag("json")
+	return dec.Decode(v)
+}
@@ -0,0 +1,258 @@
+package socket
+
+import (
+	"log"
+	"time"
+
+	"github.com/saifwork/socket-service/metrics"
+	"github.com/saifwork/socket-service/types"
+)
+
+// messageClass groups outbound messages by how much losing one hurts.
+type messageClass string
+
+const (
+	// Periodic state such as the active user count, superseded by the
+	// next update anyway.
+	classPresence messageClass = "presence"
+
+	// Offer/answer/ICE relay, the call breaks when one is lost.
+	classSignaling messageClass = "signaling"
+
+	// Everything else: acks, errors, pairing and room events.
+	classControl messageClass = "control"
+)
+
+// Backpressure policies applied when a client's send buffer is full.
+const (
+	// Drop the oldest queued message of the same or a less important
+	// class to make room, signaling excepted. When there is none, presence
+	// is dropped and other classes fall back to PolicyDisconnect.
+	PolicyDropOldest = "drop_oldest"
+
+	// Drop queued presence messages to make room. When there are none,
+	// falls back to PolicyDisconnect.
+	PolicyDropPresence = "drop_presence"
+
+	// Hold the message back until there is room, and disconnect the
+	// client when it doesn't drain within the backpressure timeout.
+	PolicyDisconnect = "disconnect"
+)
+
+func classOf(action string) messageClass {
+	switch action {
+	case types.ActionActiveUsers, types.ActionPresenceStats, types.ActionQueueStatus:
+		return classPresence
+	case types.ActionOfferReq, types.ActionAnswerReq, types.ActionAnswerRec,
+		types.ActionIceCandidateRec, types.ActionOfferCollision,
+		types.ActionRenegotiateReq, types.ActionIceRestartReq,
+		types.ActionEndOfCandidatesRec:
+		return classSignaling
+	default:
+		return classControl
+	}
+}
+
+// rank orders the classes by how much losing a message hurts.
+func (class messageClass) rank() int {
+	switch class {
+	case classPresence:
+		return 0
+	case classSignaling:
+		return 2
+	default:
+		return 1
+	}
+}
+
+func (h *Hub) policyFor(class messageClass) string {
+	switch class {
+	case classPresence:
+		return h.config.BackpressurePresence
+	case classSignaling:
+		return h.config.BackpressureSignaling
+	default:
+		return h.config.BackpressureControl
+	}
+}
+
+// deliver queues a message for the client. When the send buffer is full,
+// the backpressure policy of the message class decides what gives way, and
+// every dropped message is counted in metrics. It never blocks, so a slow
+// client can't hold up the hub or other clients. Must not be called with
+// the hub lock held.
+func (h *Hub) deliver(client *Client, mr *MessageResponse) {
+	client.sendMu.Lock()
+	defer client.sendMu.Unlock()
+
+	class := classOf(mr.Action)
+	if client.sendClosed {
+		metrics.Inc("messages_dropped", "class", string(class), "reason", "closed")
+		return
+	}
+
+	// Messages held back go first, later ones queue up behind them
+	if len(client.overflow) == 0 {
+		select {
+		case client.send <- mr:
+			return
+		default:
+		}
+
+		switch h.policyFor(class) {
+		case PolicyDropOldest:
+			evictable := func(old messageClass) bool {
+				return old != classSignaling && old.rank() <= class.rank()
+			}
+			if client.evict(evictable, 1, PolicyDropOldest) > 0 {
+				select {
+				case client.send <- mr:
+					return
+				default:
+				}
+			}
+			if class == classPresence {
+				metrics.Inc("messages_dropped", "class", string(class), "reason", PolicyDropOldest)
+				return
+			}
+
+		case PolicyDropPresence:
+			isPresence := func(old messageClass) bool { return old == classPresence }
+			if client.evict(isPresence, sendBufferSize, PolicyDropPresence) > 0 {
+				select {
+				case client.send <- mr:
+					return
+				default:
+				}
+			}
+		}
+	}
+
+	// Disconnect policy, also the fallback when nothing could be evicted.
+	// A client already being disconnected gets nothing more.
+	if client.slow {
+		metrics.Inc("messages_dropped", "class", string(class), "reason", PolicyDisconnect)
+		return
+	}
+	if len(client.overflow) >= sendBufferSize {
+		metrics.Inc("messages_dropped", "class", string(class), "reason", PolicyDisconnect)
+		h.disconnectSlowLocked(client)
+		return
+	}
+
+	client.overflow = append(client.overflow, mr)
+	if client.overflowTimer == nil {
+		client.overflowTimer = time.AfterFunc(h.config.BackpressureTimeout, func() {
+			h.backpressureTimeout(client)
+		})
+	}
+}
+
+// backpressureTimeout disconnects a client that still has messages held
+// back once the backpressure timeout ran out.
+func (h *Hub) backpressureTimeout(client *Client) {
+	client.sendMu.Lock()
+	defer client.sendMu.Unlock()
+
+	client.overflowTimer = nil
+	if len(client.overflow) > 0 && !client.slow {
+		h.disconnectSlowLocked(client)
+	}
+}
+
+// disconnectSlowLocked drops the messages held back for a client that
+// doesn't drain its send buffer, and closes its connection. Must be called
+// with sendMu held.
+func (h *Hub) disconnectSlowLocked(client *Client) {
+	client.slow = true
+	for _, mr := range client.overflow {
+		metrics.Inc("messages_dropped", "class", string(classOf(mr.Action)), "reason", PolicyDisconnect)
+	}
+	client.dropOverflowLocked()
+
+	metrics.Inc("slow_consumers_disconnected")
+	log.Printf("Client %s did not drain its send buffer in %s, disconnecting", client.ID, h.config.BackpressureTimeout)
+	go h.closeConn(client)
+}
+
+// refill moves messages held back by backpressure into the send buffer as
+// it drains, keeping their order.
+func (c *Client) refill() {
+	c.sendMu.Lock()
+	defer c.sendMu.Unlock()
+
+	for len(c.overflow) > 0 && !c.sendClosed {
+		select {
+		case c.send <- c.overflow[0]:
+			c.overflow = c.overflow[1:]
+		default:
+			return
+		}
+	}
+	if len(c.overflow) == 0 {
+		c.dropOverflowLocked()
+	}
+}
+
+// dropOverflowLocked forgets the messages held back and stops the timer
+// waiting for them. Must be called with sendMu held.
+func (c *Client) dropOverflowLocked() {
+	c.overflow = nil
+	if c.overflowTimer != nil {
+		c.overflowTimer.Stop()
+		c.overflowTimer = nil
+	}
+}
+
+// evict removes up to limit queued messages, oldest first, whose class
+// matches, counting them as dropped for the policy, and returns how many
+// were. The others keep their order. Must be called with sendMu held.
+func (c *Client) evict(match func(messageClass) bool, limit int, policy string) int {
+	var kept []*MessageResponse
+	evicted := 0
+
+drain:
+	for {
+		select {
+		case mr := <-c.send:
+			if class := classOf(mr.Action); evicted < limit && match(class) {
+				evicted++
+				metrics.Inc("messages_dropped", "class", string(class), "reason", policy)
+				continue
+			}
+			kept = append(kept, mr)
+		default:
+			break drain
+		}
+	}
+
+	for _, mr := range kept {
+		c.send <- mr
+	}
+	return evicted
+}
+
+// closeSend closes the send channel for good, which stops the WritePump.
+// Later deliveries are dropped.
+func (c *Client) closeSend() {
+	c.sendMu.Lock()
+	defer c.sendMu.Unlock()
+
+	if !c.sendClosed {
+		c.sendClosed = true
+		close(c.send)
+		c.dropOverflowLocked()
+	}
+}
+
+// closeConn closes the client's current connection, so its pumps stop and
+// the client gets unregistered.
+func (h *Hub) closeConn(client *Client) {
+	h.mu.Lock()
+	conn := client.conn
+	h.mu.Unlock()
+
+	if conn != nil {
+		_ = conn.Close()
+	}
+}
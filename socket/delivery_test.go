@@ -0,0 +1,101 @@
+package socket
+
+import (
+	"testing"
+	"time"
+
+	"github.com/saifwork/socket-service/configs"
+	"github.com/saifwork/socket-service/types"
+)
+
+// newDeliveryHub uses the default backpressure policies.
+func newDeliveryHub() *Hub {
+	return NewHub(&configs.Config{
+		BackpressurePresence:  PolicyDropOldest,
+		BackpressureSignaling: PolicyDropPresence,
+		BackpressureControl:   PolicyDisconnect,
+		BackpressureTimeout:   time.Minute,
+	})
+}
+
+func queued(c *Client) []string {
+	var actions []string
+	for len(c.send) > 0 {
+		actions = append(actions, (<-c.send).Action)
+	}
+	return actions
+}
+
+func TestPresenceNeverEvictsSignaling(t *testing.T) {
+	for _, action := range []string{types.ActionActiveUsers, types.ActionPresenceStats, types.ActionQueueStatus} {
+		t.Run(action, func(t *testing.T) {
+			h := newDeliveryHub()
+			c := newRoomClient(h, "slow")
+			for len(c.send) < cap(c.send) {
+				h.deliver(c, &MessageResponse{Action: types.ActionAnswerReq})
+			}
+
+			h.deliver(c, &MessageResponse{Action: action})
+
+			got := queued(c)
+			if len(got) != sendBufferSize {
+				t.Fatalf("%d messages queued, want %d", len(got), sendBufferSize)
+			}
+			for i, a := range got {
+				if a != types.ActionAnswerReq {
+					t.Fatalf("message %d is %s, want %s", i, a, types.ActionAnswerReq)
+				}
+			}
+			if len(c.overflow) != 0 || c.slow {
+				t.Fatal("presence was held back or disconnected the client")
+			}
+		})
+	}
+}
+
+func TestPresenceEvictsOldestPresence(t *testing.T) {
+	h := newDeliveryHub()
+	c := newRoomClient(h, "slow")
+	h.deliver(c, &MessageResponse{Action: types.ActionAnswerReq})
+	h.deliver(c, &MessageResponse{Action: types.ActionActiveUsers})
+	for len(c.send) < cap(c.send) {
+		h.deliver(c, &MessageResponse{Action: types.ActionIceCandidateRec})
+	}
+
+	h.deliver(c, &MessageResponse{Action: types.ActionQueueStatus})
+
+	got := queued(c)
+	if got[0] != types.ActionAnswerReq || got[1] != types.ActionIceCandidateRec {
+		t.Fatalf("queue starts with %v, want the answer then candidates", got[:2])
+	}
+	if last := got[len(got)-1]; last != types.ActionQueueStatus {
+		t.Fatalf("last queued message is %s, want %s", last, types.ActionQueueStatus)
+	}
+	for _, a := range got {
+		if a == types.ActionActiveUsers {
+			t.Fatal("the old presence message was kept")
+		}
+	}
+}
+
+func TestSignalingHeldBackWhenBufferFull(t *testing.T) {
+	h := newDeliveryHub()
+	c := newRoomClient(h, "slow")
+	for len(c.send) < cap(c.send) {
+		h.deliver(c, &MessageResponse{Action: types.ActionIceCandidateRec})
+	}
+
+	h.deliver(c, &MessageResponse{Action: types.ActionAnswerReq})
+	defer c.closeSend()
+
+	if len(c.overflow) != 1 || c.overflow[0].Action != types.ActionAnswerReq {
+		t.Fatalf("answer was not held back, overflow is %d long", len(c.overflow))
+	}
+	if len(queued(c)) != sendBufferSize {
+		t.Fatal("queued signaling was dropped")
+	}
+	c.refill()
+	if got := queued(c); len(got) != 1 || got[0] != types.ActionAnswerReq {
+		t.Fatalf("refill queued %v, want the answer", got)
+	}
+}
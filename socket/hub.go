@@ -1,25 +1,31 @@
 package socket
 
 import (
-	"encoding/json"
-	"net/http"
+	"crypto/subtle"
+	"math/rand"
+	"sort"
 	"sync"
 	"time"
 
 	log "log"
 
-	"math/rand"
-
-	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+	"github.com/saifwork/socket-service/auth"
+	"github.com/saifwork/socket-service/blocks"
+	"github.com/saifwork/socket-service/configs"
+	"github.com/saifwork/socket-service/geo"
+	"github.com/saifwork/socket-service/history"
 	"github.com/saifwork/socket-service/responses"
+	"github.com/saifwork/socket-service/sdp"
+	"github.com/saifwork/socket-service/turn"
 	"github.com/saifwork/socket-service/types"
 )
 
 // Hub maintains the set of active clients and broadcasts messages to the
 // clients.
 type Hub struct {
-	// Gin context
-	ctx *gin.Context
+	// Service configuration
+	config *configs.Config
 
 	// Registered clients.
 	clients map[*Client]time.Time
@@ -31,34 +37,102 @@ type Hub struct {
 	register chan *Client
 
 	// Unregister requests from clients.
-	unregister chan *Client
+	unregister chan *connRef
 
 	mu sync.Mutex // Mutex to protect the clients map
+
+	// Group call rooms by ID.
+	rooms   map[string]*Room
+	roomsMu sync.Mutex // Mutex to protect the rooms map
+
+	// Pending private invites by code.
+	invites   map[string]*Invite
+	invitesMu sync.Mutex // Mutex to protect the invites map
+
+	// Recent pairings, to estimate waiting times.
+	matches matchRate
+
+	// Active pairings by session ID, protected by mu.
+	sessions map[string]*session
+
+	// Policy enforced on relayed SDPs, nil when they are relayed untouched.
+	sdpPolicy *sdp.Policy
+
+	// Embedded TURN server handing out credentials with matches, if any.
+	turnServer *turn.Server
+
+	// Where ended sessions are recorded, if anywhere.
+	sessionStore history.Store
+
+	// Who each uId was recently paired with, avoided by the matcher.
+	recent *recentPartners
+
+	// Where blocks are persisted, and those of the connected uIds.
+	blockStore blocks.Store
+	blocks     *blockCache
+
+	// GeoIP database locating clients that don't report where they are.
+	locator *geo.Locator
+
+	// Verifies the tokens of connecting clients, nil when tokens aren't
+	// accepted.
+	verifier *auth.Verifier
+}
+
+// connRef identifies one websocket connection of a client, so that an old
+// connection closing after a resume doesn't detach the new one.
+type connRef struct {
+	client *Client
+	conn   *websocket.Conn
 }
 
-func NewHub() *Hub {
+func NewHub(config *configs.Config) *Hub {
 	hub := &Hub{
+		config:     config,
 		Broadcast:  make(chan *ClientMessage),
 		register:   make(chan *Client),
-		unregister: make(chan *Client),
+		unregister: make(chan *connRef),
 		clients:    make(map[*Client]time.Time),
+		rooms:      make(map[string]*Room),
+		invites:    make(map[string]*Invite),
+		sessions:   make(map[string]*session),
+		sdpPolicy:  newSDPPolicy(config),
+		recent:     newRecentPartners(config.RecentPartnerHistory, config.RecentPartnerTTL),
+		blocks:     newBlockCache(),
 	}
 
 	return hub
 }
 
-func (h *Hub) SetContext(c *gin.Context) {
-	h.ctx = c
+// SetTURNServer makes matches come with credentials for the embedded TURN
+// server. Must be called before Run.
+func (h *Hub) SetTURNServer(s *turn.Server) {
+	h.turnServer = s
 }
 
-func (h *Hub) SendMessage(clientMessage *ClientMessage) {
-	select {
-	case clientMessage.Client.send <- clientMessage.Message:
-	default:
-		close(clientMessage.Client.send)
-		delete(h.clients, clientMessage.Client)
-		log.Printf("[%s] Total clients %d closing connection for: %s", time.Now(), len(h.clients), clientMessage.Client.ID)
+// SetSessionStore makes ended sessions be recorded in store. Must be called
+// before Run.
+func (h *Hub) SetSessionStore(store history.Store) {
+	h.sessionStore = store
+}
+
+// Paired reports whether the client with the given uId is currently
+// paired, and both sides accepted the match. Only paired clients may use
+// the embedded TURN server.
+func (h *Hub) Paired(uid string) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	client := h.GetClientByID(uid)
+	if client == nil {
+		return false
 	}
+	s, ok := h.sessions[client.SessionID]
+	return ok && s.bothAccepted()
+}
+
+func (h *Hub) SendMessage(clientMessage *ClientMessage) {
+	h.deliver(clientMessage.Client, clientMessage.Message)
 }
 
 func (hub *Hub) Run() {
@@ -66,41 +140,77 @@ func (hub *Hub) Run() {
 	// Start cleaning process
 	hub.cleanClients()
 
+	// Start the coalesced presence updates
+	hub.broadcastPresence()
+
+	// Start the queue status updates for waiting clients
+	hub.broadcastQueueStatus()
+
 	for {
 		select {
 		case client := <-hub.register:
 			hub.mu.Lock()
 			hub.clients[client] = time.Now()
+			activeUsers := len(hub.clients)
 			hub.mu.Unlock()
 
-			// Broadcast the updated user count
-			hub.BroadcastUserCount()
+			// Give the new client the current count right away, the others
+			// get it with the next presence update
+			client.sendMessage(types.ActionActiveUsers, activeUsers)
 
-		case client := <-hub.unregister:
-			hub.mu.Lock()
-			if _, ok := hub.clients[client]; ok {
-				delete(hub.clients, client)
-				close(client.send)
+		case ref := <-hub.unregister:
+			if !hub.detach(ref) {
+				// Already gone, or kept while it may still resume
+				continue
 			}
-			hub.mu.Unlock()
-
-			// Broadcast the updated user count
-			hub.BroadcastUserCount()
+			hub.removed(ref.client)
 
 		case message := <-hub.Broadcast:
 			// Handle normal broadcast logic
-			for client := range hub.clients {
-				select {
-				case client.send <- message.Message:
-				default:
-					close(client.send)
-					delete(hub.clients, client)
-				}
+			for _, client := range hub.snapshotClients() {
+				hub.deliver(client, message.Message)
 			}
 		}
 	}
 }
 
+// snapshotClients returns the registered clients, to iterate over them
+// without holding the hub lock.
+func (h *Hub) snapshotClients() []*Client {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	clients := make([]*Client, 0, len(h.clients))
+	for client := range h.clients {
+		clients = append(clients, client)
+	}
+	return clients
+}
+
+// Stats is a snapshot of the hub state, served on the admin endpoints.
+type Stats struct {
+	Clients int `json:"clients"`
+	Waiting int `json:"waiting"`
+
+	// Waiting clients by matchmaking tier
+	WaitingByTier map[string]int `json:"waitingByTier"`
+}
+
+// Stats returns the current number of connected and waiting clients.
+func (h *Hub) Stats() Stats {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	stats := Stats{Clients: len(h.clients), WaitingByTier: make(map[string]int)}
+	for client := range h.clients {
+		if client.IsWaiting {
+			stats.Waiting++
+			stats.WaitingByTier[client.Tier]++
+		}
+	}
+	return stats
+}
+
 // Function to find a client by their ID
 func (h *Hub) GetClientByID(id string) *Client {
 	for client := range h.clients {
@@ -125,6 +235,10 @@ func (h *Hub) GetWaitingClientByUID(uid string) *Client {
 	return nil // Return nil if no matching client is found
 }
 
+// GetWaitingClients returns the clients waiting for a match, in pool order:
+// clients requeued after a failed match first, then the longest waiting.
+// Detached clients keep their place but are left out until they resume, as
+// they can't accept a match.
 func (h *Hub) GetWaitingClients() []*Client {
 
 	h.mu.Lock()         // Lock before accessing
@@ -132,62 +246,90 @@ func (h *Hub) GetWaitingClients() []*Client {
 
 	var waitingClients []*Client
 	for client := range h.clients {
-
-		log.Println(client)
-		if client.IsWaiting {
+		if client.IsWaiting && !client.detached {
 			waitingClients = append(waitingClients, client)
 		}
 	}
 
+	// Requeued clients first, then the longest waiting
+	sort.Slice(waitingClients, func(i, j int) bool {
+		a, b := waitingClients[i], waitingClients[j]
+		if a.requeued != b.requeued {
+			return a.requeued
+		}
+		return a.EnterAt.Before(b.EnterAt)
+	})
+
 	// log.Println(waitingClients)
 	return waitingClients
 }
 
+// How often the matcher pairs the waiting pool.
+const matchInterval = time.Second
+
 func (h *Hub) PairWaitingClients() {
 
 	log.Println("Starting PairWaitingClients")
 
+	// Since when each waiting client only had recent partners to pair with
+	avoiding := make(map[*Client]time.Time)
+	rng := rand.New(rand.NewSource(time.Now().UnixNano()))
+
 	for {
-		time.Sleep(1 * time.Second) // Check every 5 seconds
+		time.Sleep(matchInterval)
 
 		waitingClients := h.GetWaitingClients() // Fetch waiting clients
 
-		if len(waitingClients) < 2 {
-			continue // If less than two clients are waiting, wait for more
+		// Forget the clients that left the pool
+		waiting := make(map[*Client]bool, len(waitingClients))
+		for _, client := range waitingClients {
+			waiting[client] = true
+		}
+		for client := range avoiding {
+			if !waiting[client] {
+				delete(avoiding, client)
+			}
 		}
 
-		var client1, client2 *Client
-
-		if len(waitingClients) == 2 {
-			// If exactly two waiting clients, just pair them
-			client1 = waitingClients[0]
-			client2 = waitingClients[1]
-		} else {
-			// If more than two, pick two random clients
-
-			source := rand.NewSource(time.Now().UnixNano())
-			rng := rand.New(source)
-
-			index1 := rng.Intn(len(waitingClients))
-			index2 := rng.Intn(len(waitingClients))
-
-			// Ensure index1 and index2 are not the same
-			for index1 == index2 {
-				index2 = rng.Intn(len(waitingClients))
+		// Pair as many clients as possible
+		now := time.Now()
+		candidates := h.candidates(waitingClients, now)
+		for len(candidates) >= 2 {
+			i, j, ok := h.pickPair(rng, candidates, avoiding, now)
+			if !ok {
+				break
 			}
 
-			client1 = waitingClients[index1]
-			client2 = waitingClients[index2]
+			h.pairWaiting(candidates[i].client, candidates[j].client)
+			candidates = without(candidates, i, j)
 		}
+	}
+}
 
-		// Set both clients' IsWaiting to false
-		client1.IsWaiting = false
-		client2.IsWaiting = false
-
-		// Notify first clients about the pairing (you can customize this message)
-		go client1.sendConnectionRequest(client2.ID, types.ActionOfferReq)
-		// go client2.sendConnectionRequest(client1.ID, types.ActionAnswerReq)
+// pairWaiting pairs two clients of the waiting pool. Both are checked to
+// still be waiting under the hub lock, so a client that stopped searching
+// in the meantime is left alone. It reports whether they were paired.
+func (h *Hub) pairWaiting(client1, client2 *Client) bool {
+	h.mu.Lock()
+	if !client1.IsWaiting || !client2.IsWaiting {
+		h.mu.Unlock()
+		return false
+	}
+	now := time.Now()
+	waited := []time.Duration{now.Sub(client1.EnterAt), now.Sub(client2.EnterAt)}
+	s, notify := h.linkLocked(client1, client2, true)
+	h.mu.Unlock()
+	for _, n := range notify {
+		n()
 	}
+	h.matches.record(now)
+	for i, client := range []*Client{client1, client2} {
+		recordWait(waited[i], client.Tier)
+	}
+
+	// Notify both clients about the pairing, they have to accept it
+	h.announceMatch(s)
+	return true
 }
 
 // SendUserMessage sends a success response with the client's user data.
@@ -197,16 +339,7 @@ func (client *Client) sendConnectionRequest(remoteUser, action string) {
 		Message: responses.NewSuccessResponse(remoteUser),
 	}
 
-	msg, err := json.Marshal(mr)
-	if err != nil {
-		log.Printf("Failed to marshal user data: %s", err)
-
-		// Aborting context with error response
-		client.hub.ctx.AbortWithStatusJSON(http.StatusBadRequest, responses.NewErrorResponse(http.StatusBadRequest, err.Error(), nil))
-		return
-	}
-
-	client.send <- msg
+	client.hub.deliver(client, mr)
 	// Create and send the ClientMessage
 	// cm := &ClientMessage{
 	// 	Client:  client,
@@ -215,7 +348,8 @@ func (client *Client) sendConnectionRequest(remoteUser, action string) {
 	// client.hub.Broadcast <- cm
 }
 
-// BroadcastUserCount sends the current number of connected clients to all clients.
+// BroadcastUserCount sends the current number of connected clients to the
+// clients subscribed to it.
 func (hub *Hub) BroadcastUserCount() {
 	hub.mu.Lock()
 	activeUsers := len(hub.clients)
@@ -226,15 +360,10 @@ func (hub *Hub) BroadcastUserCount() {
 		Action:  types.ActionActiveUsers,
 		Message: responses.NewSuccessResponse(activeUsers),
 	}
-	msg, err := json.Marshal(mr)
-	if err != nil {
-		log.Printf("Failed to marshal start chat ack: %s", err)
-		return
-	}
 
-	// Send the message to all connected clients
-	for client := range hub.clients {
-		client.send <- msg
+	// Send the message to all subscribed clients
+	for _, client := range hub.presenceSubscribers(PresenceLevelCount) {
+		hub.deliver(client, mr)
 	}
 }
 
@@ -245,30 +374,133 @@ func (h *Hub) cleanClients() {
 	go func() {
 		for range time.Tick(loopTime) {
 			// log.Printf("[%s] Total connected clients: %d", time.Now(), len(h.clients))
+			var stale []*Client
+			h.mu.Lock()
 			for client, createdAt := range h.clients {
 				td := time.Since(createdAt).Seconds()
 				// Closing inactive clients stored since more than 60 secs
 				if td > 300. {
-
-					mr := &MessageResponse{
-						Action:  types.ActionConnected,
-						Message: responses.NewSuccessResponse(false),
-					}
-
-					msg, err := json.Marshal(mr)
-					if err != nil {
-						log.Printf("Failed to marshal user data: %s", err)
-
-						client.hub.ctx.AbortWithStatusJSON(http.StatusBadRequest, responses.NewErrorResponse(http.StatusBadRequest, err.Error(), nil))
-						return
-					}
-
-					client.send <- msg
 					// log.Printf("[%s] Total clients: %d - Cleaning client %s inactive since %f secs", time.Now(), len(h.clients), client.ID, td)
 					delete(h.clients, client)
-					close(client.send)
+					stale = append(stale, client)
 				}
 			}
+			h.mu.Unlock()
+
+			for _, client := range stale {
+				mr := &MessageResponse{
+					Action:  types.ActionConnected,
+					Message: responses.NewSuccessResponse(&Connected{Connected: false}),
+				}
+
+				h.deliver(client, mr)
+				client.closeSend()
+				h.removed(client)
+			}
 		}
 	}()
 }
+
+// detach handles a closed connection. When resumption is enabled the client
+// stays registered for the grace window, with its outbound messages queued
+// until it reconnects; otherwise it is removed right away. It reports
+// whether the client was removed.
+func (h *Hub) detach(ref *connRef) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	client := ref.client
+	if _, ok := h.clients[client]; !ok {
+		return false
+	}
+
+	// A connection replaced by a resume, the client is already on a new one
+	if client.conn != ref.conn || client.detached {
+		return false
+	}
+
+	if h.config.ResumeGrace <= 0 {
+		delete(h.clients, client)
+		client.closeSend()
+		return true
+	}
+
+	client.detached = true
+	client.queueSend()
+	client.graceTimer = time.AfterFunc(h.config.ResumeGrace, func() {
+		h.expire(client)
+	})
+	log.Printf("Client %s detached, waiting %s for it to resume", client.ID, h.config.ResumeGrace)
+
+	return false
+}
+
+// expire removes a detached client whose grace window ran out.
+func (h *Hub) expire(client *Client) {
+	h.mu.Lock()
+	if _, ok := h.clients[client]; !ok || !client.detached {
+		h.mu.Unlock()
+		return
+	}
+	delete(h.clients, client)
+	h.mu.Unlock()
+	client.closeSend()
+
+	log.Printf("Client %s did not resume in time", client.ID)
+	h.removed(client)
+}
+
+// resume re-attaches conn to the registered client matching uid and token,
+// keeping its partner and session. Messages queued while the client was
+// away are flushed by the new WritePump. It returns the client with its new
+// resume token, or nil when there is no such client.
+func (h *Hub) resume(uid, token string, conn *websocket.Conn, codec Codec, batch bool) (*Client, string) {
+	h.mu.Lock()
+
+	var client *Client
+	for c := range h.clients {
+		if c.ID == uid && c.resumeToken != "" && subtle.ConstantTimeCompare([]byte(c.resumeToken), []byte(token)) == 1 {
+			client = c
+			break
+		}
+	}
+	if client == nil {
+		h.mu.Unlock()
+		return nil, ""
+	}
+
+	if client.detached {
+		client.graceTimer.Stop()
+	} else {
+		// The old connection hasn't noticed it is gone yet, retire it
+		client.queueSend()
+		_ = client.conn.Close()
+	}
+
+	client.conn = conn
+	client.codec = codec
+	client.batch = batch
+	client.detached = false
+
+	// A token is good for one resume only
+	client.resumeToken = GenResumeToken()
+	resumeToken := client.resumeToken
+
+	client.sendMu.Lock()
+	client.slow = false
+	client.sendMu.Unlock()
+	client.Addr = conn.RemoteAddr().String()
+	partnerID := client.PartnerID
+	h.mu.Unlock()
+
+	go client.WritePump()
+	go client.ReadPump()
+
+	log.Printf("Client %s resumed its session", client.ID)
+
+	if partner := h.GetWaitingClientByUID(partnerID); partner != nil {
+		partner.sendMessage(types.ActionPeerReconnected, client.ID)
+	}
+
+	return client, resumeToken
+}
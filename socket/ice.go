@@ -0,0 +1,54 @@
+package socket
+
+import (
+	"errors"
+	"strings"
+)
+
+// Longest candidate line accepted, real ones stay well under it.
+const maxCandidateLength = 1024
+
+var (
+	ErrCandidateTarget   = errors.New("uId is required")
+	ErrCandidateFormat   = errors.New(`candidate must start with "candidate:"`)
+	ErrCandidateTooLong  = errors.New("candidate is too long")
+	ErrCandidateNoMLine  = errors.New("sdpMid or sdpMLineIndex is required")
+	ErrCandidateFragment = errors.New("usernameFragment is too long")
+)
+
+// IsEndOfCandidates reports whether the candidate marks the end of
+// candidates, which browsers send as an empty candidate.
+func (ic *IceCandidate) IsEndOfCandidates() bool {
+	return ic.Candidate == ""
+}
+
+// Validate checks the candidate the way RTCIceCandidate does: a candidate
+// line, and a media section given by sdpMid or sdpMLineIndex.
+func (ic *IceCandidate) Validate() error {
+	if ic.ID == "" {
+		return ErrCandidateTarget
+	}
+
+	if len(ic.Candidate) > maxCandidateLength {
+		return ErrCandidateTooLong
+	}
+	if ic.UsernameFragment != nil && len(*ic.UsernameFragment) > 256 {
+		return ErrCandidateFragment
+	}
+
+	if ic.IsEndOfCandidates() {
+		return nil
+	}
+
+	// Some stacks send the SDP attribute form
+	ic.Candidate = strings.TrimPrefix(ic.Candidate, "a=")
+	if !strings.HasPrefix(ic.Candidate, "candidate:") {
+		return ErrCandidateFormat
+	}
+
+	if ic.SdpMid == nil && ic.SdpMLineIndex == nil {
+		return ErrCandidateNoMLine
+	}
+
+	return nil
+}
@@ -0,0 +1,200 @@
+package socket
+
+import (
+	"encoding/json"
+	"errors"
+	"math"
+	"testing"
+)
+
+// Payloads of RTCIceCandidate.toJSON() as captured from browsers, wrapped
+// in the ice_candidate_res envelope the frontend sends.
+var browserCandidates = []struct {
+	name    string
+	payload string
+
+	candidate     string
+	sdpMid        *string
+	sdpMLineIndex *uint16
+	ufrag         *string
+	end           bool
+}{
+	{
+		name:          "chrome srflx",
+		payload:       `{"candidate":"candidate:842163049 1 udp 1677729535 203.0.113.5 54321 typ srflx raddr 0.0.0.0 rport 0 generation 0 ufrag EsAw network-id 1 network-cost 10","sdpMid":"0","sdpMLineIndex":0,"usernameFragment":"EsAw"}`,
+		candidate:     "candidate:842163049 1 udp 1677729535 203.0.113.5 54321 typ srflx raddr 0.0.0.0 rport 0 generation 0 ufrag EsAw network-id 1 network-cost 10",
+		sdpMid:        ptr("0"),
+		sdpMLineIndex: ptr(uint16(0)),
+		ufrag:         ptr("EsAw"),
+	},
+	{
+		name:          "chrome mdns host on second m-line",
+		payload:       `{"candidate":"candidate:2436137353 1 udp 2122260223 8f6a9e4c-3d2b-4c1a-9a7e-0b5d6c7e8f90.local 61582 typ host generation 0 ufrag EsAw network-id 1","sdpMid":"1","sdpMLineIndex":1,"usernameFragment":"EsAw"}`,
+		candidate:     "candidate:2436137353 1 udp 2122260223 8f6a9e4c-3d2b-4c1a-9a7e-0b5d6c7e8f90.local 61582 typ host generation 0 ufrag EsAw network-id 1",
+		sdpMid:        ptr("1"),
+		sdpMLineIndex: ptr(uint16(1)),
+		ufrag:         ptr("EsAw"),
+	},
+	{
+		name:          "firefox host",
+		payload:       `{"candidate":"candidate:0 1 UDP 2122252543 192.168.1.20 57312 typ host","sdpMid":"0","sdpMLineIndex":0,"usernameFragment":"7e2a6c1b"}`,
+		candidate:     "candidate:0 1 UDP 2122252543 192.168.1.20 57312 typ host",
+		sdpMid:        ptr("0"),
+		sdpMLineIndex: ptr(uint16(0)),
+		ufrag:         ptr("7e2a6c1b"),
+	},
+	{
+		name:          "firefox end of candidates",
+		payload:       `{"candidate":"","sdpMid":"0","sdpMLineIndex":0,"usernameFragment":"7e2a6c1b"}`,
+		sdpMid:        ptr("0"),
+		sdpMLineIndex: ptr(uint16(0)),
+		ufrag:         ptr("7e2a6c1b"),
+		end:           true,
+	},
+	{
+		name:          "safari relay",
+		payload:       `{"candidate":"candidate:1052353571 1 udp 41885695 198.51.100.7 3478 typ relay raddr 203.0.113.5 rport 54321 generation 0 ufrag 2Pnq network-cost 999","sdpMid":"0","sdpMLineIndex":0,"usernameFragment":"2Pnq"}`,
+		candidate:     "candidate:1052353571 1 udp 41885695 198.51.100.7 3478 typ relay raddr 203.0.113.5 rport 54321 generation 0 ufrag 2Pnq network-cost 999",
+		sdpMid:        ptr("0"),
+		sdpMLineIndex: ptr(uint16(0)),
+		ufrag:         ptr("2Pnq"),
+	},
+	{
+		name:          "safari null sdpMid",
+		payload:       `{"candidate":"candidate:3127423373 1 tcp 1518280447 192.168.1.30 9 typ host tcptype active generation 0","sdpMid":null,"sdpMLineIndex":1,"usernameFragment":null}`,
+		candidate:     "candidate:3127423373 1 tcp 1518280447 192.168.1.30 9 typ host tcptype active generation 0",
+		sdpMLineIndex: ptr(uint16(1)),
+	},
+	{
+		name:      "sdp attribute form",
+		payload:   `{"candidate":"a=candidate:1 1 udp 2122260223 192.168.1.20 5000 typ host","sdpMid":"audio"}`,
+		candidate: "candidate:1 1 udp 2122260223 192.168.1.20 5000 typ host",
+		sdpMid:    ptr("audio"),
+	},
+}
+
+func TestBrowserCandidates(t *testing.T) {
+	for _, tt := range browserCandidates {
+		t.Run(tt.name, func(t *testing.T) {
+			message := []byte(`{"action":"ice_candidate_res","data":` + withTarget(t, tt.payload) + `}`)
+
+			var ic IceCandidate
+			if err := decodeData(jsonCodec{}, message, &ic); err != nil {
+				t.Fatalf("decode: %s", err)
+			}
+			if err := ic.Validate(); err != nil {
+				t.Fatalf("validate: %s", err)
+			}
+
+			if ic.Candidate != tt.candidate {
+				t.Errorf("candidate = %q, want %q", ic.Candidate, tt.candidate)
+			}
+			if ic.IsEndOfCandidates() != tt.end {
+				t.Errorf("end of candidates = %t, want %t", ic.IsEndOfCandidates(), tt.end)
+			}
+			if !equalPtr(ic.SdpMid, tt.sdpMid) {
+				t.Errorf("sdpMid = %v, want %v", deref(ic.SdpMid), deref(tt.sdpMid))
+			}
+			if !equalPtr(ic.SdpMLineIndex, tt.sdpMLineIndex) {
+				t.Errorf("sdpMLineIndex = %v, want %v", deref(ic.SdpMLineIndex), deref(tt.sdpMLineIndex))
+			}
+			if !equalPtr(ic.UsernameFragment, tt.ufrag) {
+				t.Errorf("usernameFragment = %v, want %v", deref(ic.UsernameFragment), deref(tt.ufrag))
+			}
+		})
+	}
+}
+
+// The same payloads go through msgpack for clients that negotiated it.
+func TestBrowserCandidatesMsgpack(t *testing.T) {
+	for _, tt := range browserCandidates {
+		t.Run(tt.name, func(t *testing.T) {
+			var data map[string]interface{}
+			if err := json.Unmarshal([]byte(withTarget(t, tt.payload)), &data); err != nil {
+				t.Fatal(err)
+			}
+			// Browser msgpack encoders write whole numbers as integers
+			for k, v := range data {
+				if f, ok := v.(float64); ok && f == math.Trunc(f) {
+					data[k] = int64(f)
+				}
+			}
+			message, err := msgpackCodec{}.Marshal(map[string]interface{}{"action": "ice_candidate_res", "data": data})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var ic IceCandidate
+			if err := decodeData(msgpackCodec{}, message, &ic); err != nil {
+				t.Fatalf("decode: %s", err)
+			}
+			if err := ic.Validate(); err != nil {
+				t.Fatalf("validate: %s", err)
+			}
+			if !equalPtr(ic.SdpMLineIndex, tt.sdpMLineIndex) {
+				t.Errorf("sdpMLineIndex = %v, want %v", deref(ic.SdpMLineIndex), deref(tt.sdpMLineIndex))
+			}
+		})
+	}
+}
+
+func TestInvalidCandidates(t *testing.T) {
+	tests := []struct {
+		name    string
+		payload string
+		err     error
+	}{
+		{"no target", `{"candidate":"candidate:1 1 udp 1 1.2.3.4 5 typ host","sdpMid":"0"}`, ErrCandidateTarget},
+		{"not a candidate", `{"uId":"peer","candidate":"hello","sdpMid":"0"}`, ErrCandidateFormat},
+		{"no media section", `{"uId":"peer","candidate":"candidate:1 1 udp 1 1.2.3.4 5 typ host","sdpMid":null,"sdpMLineIndex":null}`, ErrCandidateNoMLine},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var ic IceCandidate
+			if err := decodeData(jsonCodec{}, []byte(`{"action":"ice_candidate_res","data":`+tt.payload+`}`), &ic); err != nil {
+				t.Fatalf("decode: %s", err)
+			}
+			if err := ic.Validate(); !errors.Is(err, tt.err) {
+				t.Fatalf("validate = %v, want %v", err, tt.err)
+			}
+		})
+	}
+
+	// A negative sdpMLineIndex doesn't decode at all
+	var ic IceCandidate
+	if err := decodeData(jsonCodec{}, []byte(`{"action":"ice_candidate_res","data":{"uId":"peer","candidate":"","sdpMLineIndex":-1}}`), &ic); err == nil {
+		t.Fatal("negative sdpMLineIndex decoded")
+	}
+}
+
+// withTarget adds the uId of the peer to a toJSON() payload.
+func withTarget(t *testing.T, payload string) string {
+	t.Helper()
+
+	var data map[string]interface{}
+	if err := json.Unmarshal([]byte(payload), &data); err != nil {
+		t.Fatal(err)
+	}
+	data["uId"] = "peer"
+	out, err := json.Marshal(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(out)
+}
+
+func ptr[T any](v T) *T { return &v }
+
+func equalPtr[T comparable](a, b *T) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return *a == *b
+}
+
+func deref[T any](p *T) interface{} {
+	if p == nil {
+		return nil
+	}
+	return *p
+}
@@ -0,0 +1,64 @@
+package socket
+
+import (
+	"errors"
+	"log"
+	"net/http"
+
+	"github.com/saifwork/socket-service/configs"
+	"github.com/saifwork/socket-service/metrics"
+	"github.com/saifwork/socket-service/sdp"
+)
+
+// newSDPPolicy builds the policy enforced on relayed SDPs from the config,
+// or returns nil when SDPs are relayed untouched.
+func newSDPPolicy(config *configs.Config) *sdp.Policy {
+	if !config.SDPInspection {
+		return nil
+	}
+
+	return &sdp.Policy{
+		StripCodecs:         config.SDPStripCodecs,
+		KeepCodecs:          config.SDPKeepCodecs,
+		MaxBandwidth:        config.SDPMaxBandwidth,
+		ForbidDataChannels:  config.SDPForbidDataChannels,
+		ForbidVideo:         config.SDPForbidVideo,
+		StripHostCandidates: config.SDPStripHostCandidates,
+	}
+}
+
+// inspectSDP enforces the SDP policy on an offer or answer from the client
+// and returns the SDP to relay. SDPs of private clients are always
+// inspected, to keep only their relay candidates. When the SDP is rejected,
+// the client gets an error and false is returned.
+func (c *Client) inspectSDP(raw string) (string, bool) {
+	policy := c.hub.sdpPolicy
+	if c.private() {
+		relayOnly := sdp.Policy{}
+		if policy != nil {
+			relayOnly = *policy
+		}
+		relayOnly.RelayOnly = true
+		policy = &relayOnly
+	}
+	if policy == nil {
+		return raw, true
+	}
+
+	sanitized, err := policy.Apply(raw)
+	if err != nil {
+		reason := "policy"
+		code := http.StatusUnprocessableEntity
+		if errors.Is(err, sdp.ErrInvalid) {
+			reason = "invalid"
+			code = http.StatusBadRequest
+		}
+
+		metrics.Inc("sdp_rejected", "reason", reason)
+		log.Printf("Rejected SDP from client %s: %s", c.ID, err)
+		c.sendError(code, "SDP rejected: "+err.Error())
+		return "", false
+	}
+
+	return sanitized, true
+}
@@ -0,0 +1,185 @@
+package socket
+
+import (
+	"crypto/rand"
+	"errors"
+	"log"
+	"math/big"
+	"time"
+
+	"github.com/saifwork/socket-service/types"
+)
+
+// Alphabet of invite codes, without characters that are easy to mix up
+const inviteAlphabet = "ABCDEFGHJKLMNPQRSTUVWXYZ23456789"
+
+const inviteCodeLength = 6
+
+// Most invites a client can have pending at once
+const maxInvitesPerClient = 5
+
+var (
+	ErrInviteNotFound = errors.New("invite not found or expired")
+	ErrInviteOwn      = errors.New("cannot join your own invite")
+	ErrTooManyInvites = errors.New("too many pending invites")
+)
+
+// Invite is a single-use code pairing the client that created it with the
+// first client joining it, bypassing random matchmaking.
+type Invite struct {
+	Code      string    `json:"code"`
+	ExpiresAt time.Time `json:"expiresAt"`
+
+	creator *Client
+	timer   *time.Timer
+}
+
+type InviteRequest struct {
+	Code string `json:"code"`
+}
+
+// CreateInvite issues a new invite code for the client. Unused invites
+// expire after the configured TTL and the creator is told about it.
+func (h *Hub) CreateInvite(creator *Client) (*Invite, error) {
+	h.invitesMu.Lock()
+	defer h.invitesMu.Unlock()
+
+	pending := 0
+	for _, invite := range h.invites {
+		if invite.creator == creator {
+			pending++
+		}
+	}
+	if pending >= maxInvitesPerClient {
+		return nil, ErrTooManyInvites
+	}
+
+	var code string
+	for {
+		var err error
+		code, err = genInviteCode()
+		if err != nil {
+			return nil, err
+		}
+		if _, taken := h.invites[code]; !taken {
+			break
+		}
+	}
+
+	invite := &Invite{
+		Code:      code,
+		ExpiresAt: time.Now().Add(h.config.InviteTTL),
+		creator:   creator,
+	}
+	invite.timer = time.AfterFunc(h.config.InviteTTL, func() {
+		h.expireInvite(invite)
+	})
+	h.invites[code] = invite
+
+	log.Printf("Client %s created invite %s", creator.ID, code)
+	return invite, nil
+}
+
+// JoinInvite consumes the invite and pairs the joining client with its
+// creator. Neither may be in a call; a match of either that isn't a call
+// yet is cancelled. The invites lock is taken before the hub lock.
+func (h *Hub) JoinInvite(joiner *Client, code string) error {
+	h.invitesMu.Lock()
+	defer h.invitesMu.Unlock()
+
+	invite, ok := h.invites[code]
+	if !ok {
+		return ErrInviteNotFound
+	}
+	creator := invite.creator
+	if creator == joiner {
+		return ErrInviteOwn
+	}
+	if h.blocks.has(creator.ID, joiner.ID) {
+		// Don't tell the joiner it was blocked
+		return ErrInviteNotFound
+	}
+
+	h.mu.Lock()
+	if _, registered := h.clients[creator]; !registered {
+		h.mu.Unlock()
+		return ErrInviteNotFound
+	}
+
+	for _, client := range []*Client{creator, joiner} {
+		if s, ok := h.sessions[client.SessionID]; ok && s.established {
+			h.mu.Unlock()
+			return ErrInCall
+		}
+	}
+
+	// Pending matches are undone, the other side is told and requeued
+	var notify []func()
+	for _, client := range []*Client{creator, joiner} {
+		if s, ok := h.sessions[client.SessionID]; ok {
+			notify = append(notify, h.cancelMatchLocked(s, CancelStopped, func(c *Client) bool {
+				return c != creator && c != joiner
+			})...)
+		}
+	}
+
+	delete(h.invites, code)
+	invite.timer.Stop()
+	s, rest := h.linkLocked(creator, joiner, false)
+	notify = append(notify, rest...)
+	h.mu.Unlock()
+
+	for _, n := range notify {
+		n()
+	}
+
+	log.Printf("Client %s joined invite %s from %s", joiner.ID, code, creator.ID)
+	creator.sendMessage(types.ActionInviteJoined, joiner.ID)
+	h.announceMatch(s)
+
+	return nil
+}
+
+// dropInvites removes the pending invites of a client that left.
+func (h *Hub) dropInvites(creator *Client) {
+	h.invitesMu.Lock()
+	defer h.invitesMu.Unlock()
+
+	for code, invite := range h.invites {
+		if invite.creator == creator {
+			invite.timer.Stop()
+			delete(h.invites, code)
+		}
+	}
+}
+
+func (h *Hub) expireInvite(invite *Invite) {
+	h.invitesMu.Lock()
+	if h.invites[invite.Code] != invite {
+		h.invitesMu.Unlock()
+		return
+	}
+	delete(h.invites, invite.Code)
+	h.invitesMu.Unlock()
+
+	h.mu.Lock()
+	_, registered := h.clients[invite.creator]
+	h.mu.Unlock()
+	if registered {
+		invite.creator.sendMessage(types.ActionInviteExpired, &InviteRequest{Code: invite.Code})
+	}
+}
+
+// genInviteCode returns a short random code from inviteAlphabet.
+func genInviteCode() (string, error) {
+	b := make([]byte, inviteCodeLength)
+	max := big.NewInt(int64(len(inviteAlphabet)))
+	for i := range b {
+		n, err := rand.Int(rand.Reader, max)
+		if err != nil {
+			return "", err
+		}
+		b[i] = inviteAlphabet[n.Int64()]
+	}
+	return string(b), nil
+}
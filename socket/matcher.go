@@ -0,0 +1,212 @@
+package socket
+
+import (
+	"math/rand"
+	"sort"
+	"time"
+
+	"github.com/saifwork/socket-service/geo"
+	"github.com/saifwork/socket-service/metrics"
+)
+
+// Upper bounds, in seconds, of the match_wait_seconds buckets.
+var waitBuckets = []struct {
+	le    string
+	limit time.Duration
+}{
+	{"1", time.Second},
+	{"5", 5 * time.Second},
+	{"10", 10 * time.Second},
+	{"30", 30 * time.Second},
+	{"60", time.Minute},
+	{"120", 2 * time.Minute},
+	{"300", 5 * time.Minute},
+}
+
+// candidate is what the matcher knows of a waiting client, copied under
+// the hub lock.
+type candidate struct {
+	client   *Client
+	location geo.Location
+	waited   time.Duration
+	requeued bool
+	tier     string
+
+	languages []string
+	mode      string
+	require   MatchFilter
+	prefer    MatchFilter
+}
+
+// matchScore ranks the partners of a client, lower being better: first by
+// how many soft preferences they miss, then by distance.
+type matchScore struct {
+	penalty  int
+	distance float64
+}
+
+func (s matchScore) less(o matchScore) bool {
+	if s.penalty != o.penalty {
+		return s.penalty < o.penalty
+	}
+	return s.distance < o.distance
+}
+
+// candidates copies what the matcher needs of the waiting clients.
+func (h *Hub) candidates(waiting []*Client, now time.Time) []candidate {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	candidates := make([]candidate, len(waiting))
+	for i, client := range waiting {
+		candidates[i] = candidate{
+			client:    client,
+			location:  client.location,
+			waited:    now.Sub(client.EnterAt),
+			requeued:  client.requeued,
+			tier:      client.Tier,
+			languages: client.Languages,
+			mode:      client.Mode,
+			require:   client.Require,
+			prefer:    client.Prefer,
+		}
+	}
+	return candidates
+}
+
+// overdue reports whether the client waited past MatchMaxWait, after which
+// it gets any available partner.
+func (h *Hub) overdue(c *candidate) bool {
+	return h.config.MatchMaxWait > 0 && c.waited >= h.config.MatchMaxWait
+}
+
+// pickPair picks two candidates to pair and returns their indices, or
+// reports false when no pair should be made yet. Overdue clients go first,
+// longest waiting first, then clients requeued after a failed match, then
+// the others. Within these last two groups the order is random, weighted
+// by tier: a client of a weight 4 tier is four times as likely as one of a
+// weight 1 tier to come before the other. Each gets the best scored
+// acceptable partner, picked at random among equally scored ones.
+//
+// Clients that blocked each other or fail each other's hard filters are
+// never paired. Otherwise, an overdue client takes any partner. Others
+// aren't paired with clients too far from them for how long they waited,
+// see Hub.proximity, and avoid recent partners: a client only gets one of
+// them once it had no other candidate for RecentPartnerFallback. avoiding
+// tracks since when that is the case for each client, and belongs to the
+// caller, as does rng, so that successive picks draw independent orders.
+func (h *Hub) pickPair(rng *rand.Rand, candidates []candidate, avoiding map[*Client]time.Time, now time.Time) (int, int, bool) {
+	// Exponentially distributed keys with the tier weights as rates, the
+	// smallest first, give the weighted random order
+	keys := make([]float64, len(candidates))
+	for i := range candidates {
+		keys[i] = rng.ExpFloat64() / h.tierWeight(candidates[i].tier)
+	}
+
+	order := make([]int, len(candidates))
+	for i := range order {
+		order[i] = i
+	}
+	rank := func(c *candidate) int {
+		switch {
+		case h.overdue(c):
+			return 0
+		case c.requeued:
+			return 1
+		default:
+			return 2
+		}
+	}
+	sort.Slice(order, func(i, j int) bool {
+		a, b := &candidates[order[i]], &candidates[order[j]]
+		if ra, rb := rank(a), rank(b); ra != rb {
+			return ra < rb
+		}
+		if h.overdue(a) {
+			return a.waited > b.waited
+		}
+		return keys[order[i]] < keys[order[j]]
+	})
+
+	for _, i := range order {
+		c1 := &candidates[i]
+		overdue := h.overdue(c1)
+
+		var fresh, recent []int
+		var freshScore, recentScore matchScore
+		for j := range candidates {
+			c2 := &candidates[j]
+			if j == i || h.blocks.has(c1.client.ID, c2.client.ID) || !compatible(c1, c2) {
+				continue
+			}
+
+			distance, ok := h.proximity(c1, c2)
+			if !ok && !overdue {
+				continue
+			}
+			score := matchScore{penalty: preferencePenalty(c1, c2), distance: distance}
+
+			if !overdue && h.recent.has(c1.client.ID, c2.client.ID, now) {
+				recent, recentScore = keepBest(recent, recentScore, j, score)
+			} else {
+				fresh, freshScore = keepBest(fresh, freshScore, j, score)
+			}
+		}
+
+		if len(fresh) > 0 {
+			delete(avoiding, c1.client)
+			return i, fresh[rng.Intn(len(fresh))], true
+		}
+		if len(recent) == 0 {
+			continue
+		}
+
+		since, ok := avoiding[c1.client]
+		if !ok {
+			since = now
+			avoiding[c1.client] = now
+		}
+		if now.Sub(since) >= h.config.RecentPartnerFallback {
+			delete(avoiding, c1.client)
+			return i, recent[rng.Intn(len(recent))], true
+		}
+	}
+
+	return 0, 0, false
+}
+
+// keepBest adds candidate j to best when its score is as good as the best
+// one so far, and replaces best when it is better.
+func keepBest(best []int, bestScore matchScore, j int, score matchScore) ([]int, matchScore) {
+	switch {
+	case len(best) == 0 || score.less(bestScore):
+		return []int{j}, score
+	case score == bestScore:
+		return append(best, j), bestScore
+	default:
+		return best, bestScore
+	}
+}
+
+// without returns the candidates but those at indices i and j.
+func without(candidates []candidate, i, j int) []candidate {
+	rest := make([]candidate, 0, len(candidates)-2)
+	for k := range candidates {
+		if k != i && k != j {
+			rest = append(rest, candidates[k])
+		}
+	}
+	return rest
+}
+
+// recordWait counts how long a client of the tier waited before being
+// paired in the match_wait_seconds buckets, each counting the waits up to
+// its bound.
+func recordWait(waited time.Duration, tier string) {
+	for _, b := range waitBuckets {
+		if waited <= b.limit {
+			metrics.Inc("match_wait_seconds", "le", b.le, "tier", tier)
+		}
+	}
+	metrics.Inc("match_wait_seconds", "le", "+Inf", "tier", tier)
+}
@@ -0,0 +1,214 @@
+package socket
+
+import (
+	"fmt"
+	"math/rand"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/saifwork/socket-service/configs"
+	"github.com/saifwork/socket-service/geo"
+)
+
+// simConfig matches near clients only for a long time, so that clients
+// without a near partner are only paired through the MatchMaxWait
+// promotion.
+func simConfig() *configs.Config {
+	return &configs.Config{
+		RecentPartnerHistory:  5,
+		RecentPartnerTTL:      10 * time.Minute,
+		RecentPartnerFallback: 30 * time.Second,
+		RegionMatching:        true,
+		RegionWaitBudget:      10 * time.Second,
+		RegionRadius:          1000,
+		RegionRadiusGrowth:    10,
+		RegionMaxWait:         10 * time.Minute,
+		MatchMaxWait:          20 * time.Second,
+		TierDefault:           "free",
+		TierWeights:           map[string]float64{"free": 1, "premium": 4},
+	}
+}
+
+// arrival is a client entering the pool at some point of the simulation.
+type arrival struct {
+	at       time.Duration
+	region   string
+	tier     string
+	language string
+}
+
+// simulate runs the matcher loop of PairWaitingClients over the arrivals,
+// one tick every matchInterval, and returns how long each paired client
+// waited by tier, from its arrival to its match, along with the clients
+// left unpaired once arrivals stop and the pool settled.
+func simulate(t *testing.T, h *Hub, arrivals []arrival) (map[string][]time.Duration, int) {
+	t.Helper()
+
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	sort.Slice(arrivals, func(i, j int) bool { return arrivals[i].at < arrivals[j].at })
+
+	var pool []*Client
+	waits := make(map[string][]time.Duration)
+	avoiding := make(map[*Client]time.Time)
+	rng := rand.New(rand.NewSource(2))
+	next := 0
+
+	last := arrivals[len(arrivals)-1].at + 2*h.config.MatchMaxWait
+	for elapsed := time.Duration(0); elapsed <= last; elapsed += matchInterval {
+		now := start.Add(elapsed)
+
+		for ; next < len(arrivals) && arrivals[next].at <= elapsed; next++ {
+			a := arrivals[next]
+			client := &Client{User: User{
+				ID:        fmt.Sprintf("u%d", next),
+				EnterAt:   start.Add(a.at),
+				IsWaiting: true,
+				Languages: []string{a.language},
+				Mode:      ModeVideo,
+				Prefer:    MatchFilter{Languages: []string{a.language}},
+				Tier:      a.tier,
+			}}
+			client.location = geo.Location{Region: a.region}
+			pool = append(pool, client)
+		}
+
+		candidates := h.candidates(pool, now)
+		for len(candidates) >= 2 {
+			i, j, ok := h.pickPair(rng, candidates, avoiding, now)
+			if !ok {
+				break
+			}
+			for _, c := range []*candidate{&candidates[i], &candidates[j]} {
+				c.client.IsWaiting = false
+				waits[c.tier] = append(waits[c.tier], c.waited)
+			}
+			h.recent.record(candidates[i].client.ID, candidates[j].client.ID, now)
+			candidates = without(candidates, i, j)
+		}
+
+		var waiting []*Client
+		for _, client := range pool {
+			if client.IsWaiting {
+				waiting = append(waiting, client)
+			}
+		}
+		pool = waiting
+	}
+
+	return waits, len(pool)
+}
+
+// steadyArrivals spreads n clients evenly over d.
+func steadyArrivals(rng *rand.Rand, n int, d time.Duration) []arrival {
+	arrivals := make([]arrival, n)
+	for i := range arrivals {
+		arrivals[i] = randomArrival(rng, time.Duration(i)*d/time.Duration(n))
+	}
+	return arrivals
+}
+
+// burstyArrivals sends bursts of size clients every period, on top of a
+// steady background of one client every trickle, if any. Clients only wait
+// for the matcher, never alone in the pool for long.
+func burstyArrivals(rng *rand.Rand, bursts, size int, period, trickle time.Duration) []arrival {
+	var arrivals []arrival
+	for b := 0; b < bursts; b++ {
+		at := time.Duration(b) * period
+		for i := 0; i < size; i++ {
+			arrivals = append(arrivals, randomArrival(rng, at+time.Duration(rng.Intn(3))*time.Second))
+		}
+	}
+	if trickle <= 0 {
+		return arrivals
+	}
+	background := steadyArrivals(rng, int(time.Duration(bursts)*period/trickle), time.Duration(bursts)*period)
+	return append(arrivals, background...)
+}
+
+// randomArrival draws a client from an uneven population: most are in
+// Europe, a few in regions where they rarely find a near partner, and one
+// in four is premium.
+func randomArrival(rng *rand.Rand, at time.Duration) arrival {
+	a := arrival{at: at, region: "EU", tier: "free", language: "en"}
+	switch r := rng.Intn(20); {
+	case r < 2:
+		a.region = "OC"
+	case r < 5:
+		a.region = "NA"
+	}
+	if rng.Intn(4) == 0 {
+		a.tier = "premium"
+	}
+	if rng.Intn(3) == 0 {
+		a.language = "es"
+	}
+	return a
+}
+
+func p99(waits []time.Duration) time.Duration {
+	sorted := append([]time.Duration(nil), waits...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	return sorted[(len(sorted)*99+99)/100-1]
+}
+
+func TestMatcherWaitBound(t *testing.T) {
+	tests := []struct {
+		name     string
+		arrivals func(*rand.Rand) []arrival
+	}{
+		{"steady", func(rng *rand.Rand) []arrival { return steadyArrivals(rng, 600, 10*time.Minute) }},
+		{"sparse", func(rng *rand.Rand) []arrival { return steadyArrivals(rng, 60, 10*time.Minute) }},
+		{"bursty", func(rng *rand.Rand) []arrival { return burstyArrivals(rng, 10, 60, time.Minute, 5*time.Second) }},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := NewHub(simConfig())
+			waits, left := simulate(t, h, tt.arrivals(rand.New(rand.NewSource(1))))
+
+			// Once arrivals stop, only an odd one out may stay in the pool
+			if left > 1 {
+				t.Errorf("%d clients never paired", left)
+			}
+
+			bound := h.config.MatchMaxWait + matchInterval
+			var all []time.Duration
+			for tier, w := range waits {
+				if len(w) == 0 {
+					continue
+				}
+				all = append(all, w...)
+				if got := p99(w); got > bound {
+					t.Errorf("p99 wait of %s clients is %s, want at most %s", tier, got, bound)
+				}
+			}
+			if got := p99(all); got > bound {
+				t.Errorf("p99 wait is %s, want at most %s", got, bound)
+			}
+		})
+	}
+}
+
+// Premium clients get ahead of free ones when the pool can't pair everyone
+// at once, without free clients waiting past MatchMaxWait for it.
+func TestMatcherTierPriority(t *testing.T) {
+	h := NewHub(simConfig())
+	waits, _ := simulate(t, h, burstyArrivals(rand.New(rand.NewSource(1)), 10, 60, time.Minute, 0))
+
+	// Clients are paired on ticks, so a wait overshoots by up to one
+	if bound, got := h.config.MatchMaxWait+matchInterval, p99(waits["free"]); got > bound {
+		t.Errorf("p99 wait of free clients is %s, want at most %s", got, bound)
+	}
+
+	mean := func(w []time.Duration) time.Duration {
+		var sum time.Duration
+		for _, d := range w {
+			sum += d
+		}
+		return sum / time.Duration(len(w))
+	}
+	if free, premium := mean(waits["free"]), mean(waits["premium"]); premium > free {
+		t.Errorf("premium clients waited %s on average, more than free ones at %s", premium, free)
+	}
+}
@@ -0,0 +1,68 @@
+package socket
+
+import (
+	"sync"
+	"time"
+)
+
+// How far back pairings count towards the pairing rate.
+const matchRateWindow = 5 * time.Minute
+
+// matchRate keeps the times of recent pairings to estimate how fast the
+// waiting pool is drained.
+type matchRate struct {
+	mu      sync.Mutex
+	matches []time.Time
+}
+
+// record notes a pairing made at t.
+func (m *matchRate) record(t time.Time) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.matches = append(m.matches, t)
+	m.trim(t)
+}
+
+// perSecond returns the number of pairings per second over the window, or
+// zero when there were none.
+func (m *matchRate) perSecond(now time.Time) float64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.trim(now)
+	if len(m.matches) == 0 {
+		return 0
+	}
+
+	// Measure from the oldest pairing, so a fresh service isn't diluted by
+	// the empty part of the window
+	elapsed := now.Sub(m.matches[0])
+	if elapsed < time.Second {
+		elapsed = time.Second
+	}
+	return float64(len(m.matches)) / elapsed.Seconds()
+}
+
+// estimateWait returns the expected time until the client at position
+// (zero based) in the waiting pool is paired, or -1 without recent
+// pairings to estimate from.
+func (m *matchRate) estimateWait(position int, now time.Time) time.Duration {
+	rate := m.perSecond(now)
+	if rate == 0 {
+		return -1
+	}
+
+	// Every pairing takes two clients off the front of the pool
+	pairsAhead := position/2 + 1
+	return time.Duration(float64(pairsAhead) / rate * float64(time.Second))
+}
+
+func (m *matchRate) trim(now time.Time) {
+	cutoff := now.Add(-matchRateWindow)
+	i := 0
+	for i < len(m.matches) && m.matches[i].Before(cutoff) {
+		i++
+	}
+	m.matches = m.matches[i:]
+}
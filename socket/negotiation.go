@@ -0,0 +1,158 @@
+package socket
+
+import (
+	"log"
+	"time"
+
+	"github.com/saifwork/socket-service/metrics"
+	"github.com/saifwork/socket-service/types"
+)
+
+// How long an offer waits for its answer. An offer left unanswered, for
+// example because the partner rejected it, doesn't collide with new ones
+// after that.
+const offerTimeout = 10 * time.Second
+
+// SDP type a client sends instead of an offer when it rolled back an offer
+// of its own or dropped one it got, so neither is pending anymore.
+const sdpTypeRollback = "rollback"
+
+// Roles given to the two clients of a session with match_found. The
+// offerer makes the first offer and is the impolite peer of perfect
+// negotiation; the answerer is the polite one.
+const (
+	RoleOfferer  = "offerer"
+	RoleAnswerer = "answerer"
+)
+
+// OfferCollision tells the polite client that its offer crossed an offer
+// from its partner and lost, so it has to roll it back and answer the
+// partner's offer instead.
+type OfferCollision struct {
+	ID       string `json:"uId"`
+	Rollback bool   `json:"rollback"`
+}
+
+// Renegotiation is a new offer made during a call, for example to add a
+// screen share track or to restart ICE.
+type Renegotiation struct {
+	ID         string `json:"uId"`
+	SDP        string `json:"sdp"`
+	Type       string `json:"type"`
+	IceRestart bool   `json:"iceRestart"`
+}
+
+// IceRestartRequest asks the partner to restart ICE, which the offerer does
+// with a renegotiation carrying iceRestart.
+type IceRestartRequest struct {
+	ID string `json:"uId"`
+}
+
+// EndOfCandidates tells the partner that no more candidates will follow,
+// for one media section or, without sdpMid, for all of them.
+type EndOfCandidates struct {
+	ID     string `json:"uId"`
+	SdpMid string `json:"sdpMid,omitempty"`
+}
+
+// roleOf returns the role of the client at index i of a session.
+func roleOf(i int) string {
+	if i == 0 {
+		return RoleOfferer
+	}
+	return RoleAnswerer
+}
+
+// offerFrom tracks an offer the client sends to targetUID and resolves
+// collisions with an offer pending in the other direction: the offerer's
+// offer always wins. It reports whether the offer should be relayed.
+// Offers outside of the client's session are always relayed.
+func (h *Hub) offerFrom(client *Client, targetUID string) bool {
+	h.mu.Lock()
+	s, ok := h.sessions[client.SessionID]
+	if !ok || s.other(client).ID != targetUID {
+		h.mu.Unlock()
+		return true
+	}
+
+	now := time.Now()
+	i := s.index(client)
+	j := 1 - i
+	if !s.offerPendingAt(j, now) {
+		// A new offer replaces any earlier one from the same side
+		s.offerPending[i] = now
+		h.mu.Unlock()
+		return true
+	}
+
+	// Glare: both sides sent an offer
+	metrics.Inc("offer_collisions")
+	polite := s.clients[1]
+	if i == 0 {
+		// The offerer wins, the answerer drops its pending offer
+		s.offerPending[j] = time.Time{}
+		s.offerPending[i] = now
+	}
+	winner := s.clients[0]
+	h.mu.Unlock()
+
+	log.Printf("Offer collision in session %s, %s wins", s.ID, winner.ID)
+	polite.sendMessage(types.ActionOfferCollision, &OfferCollision{
+		ID:       winner.ID,
+		Rollback: true,
+	})
+
+	// The answerer's offer is dropped, the offerer's goes through
+	return i == 0
+}
+
+// answerFrom records an answer the client sends to targetUID, completing
+// the offer pending in the other direction. The first answer makes the
+// session a call.
+func (h *Hub) answerFrom(client *Client, targetUID string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	s, ok := h.sessions[client.SessionID]
+	if !ok || s.other(client).ID != targetUID {
+		return
+	}
+
+	s.offerPending[1-s.index(client)] = time.Time{}
+	if !s.established {
+		s.established = true
+		s.connectedAt = time.Now()
+	}
+}
+
+// rollbackFrom records that the client rolled back its own offer to
+// targetUID, or dropped the one it got from it: neither is pending anymore.
+func (h *Hub) rollbackFrom(client *Client, targetUID string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	s, ok := h.sessions[client.SessionID]
+	if !ok || s.other(client).ID != targetUID {
+		return
+	}
+	s.offerPending = [2]time.Time{}
+}
+
+// offerPendingAt reports whether the client at index i has an offer
+// waiting for an answer at now.
+func (s *session) offerPendingAt(i int, now time.Time) bool {
+	return !s.offerPending[i].IsZero() && now.Sub(s.offerPending[i]) < offerTimeout
+}
+
+// inSession reports whether targetUID is the partner of the client. With
+// inCall, the session must also be a call already.
+func (h *Hub) inSession(client *Client, targetUID string, inCall bool) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	s, ok := h.sessions[client.SessionID]
+	if !ok || s.other(client).ID != targetUID {
+		return false
+	}
+	return s.established || !inCall
+}
@@ -0,0 +1,100 @@
+package socket
+
+import (
+	"testing"
+	"time"
+
+	"github.com/saifwork/socket-service/configs"
+	"github.com/saifwork/socket-service/types"
+)
+
+// newTestSession links two clients in a session that is a call, the first
+// one being the offerer.
+func newTestSession(t *testing.T) (*Hub, *Client, *Client) {
+	t.Helper()
+
+	h := NewHub(&configs.Config{MatchAckTimeout: time.Minute})
+	offerer := &Client{hub: h, send: make(chan *MessageResponse, sendBufferSize), User: User{ID: "offerer"}}
+	answerer := &Client{hub: h, send: make(chan *MessageResponse, sendBufferSize), User: User{ID: "answerer"}}
+
+	h.mu.Lock()
+	s, _ := h.linkLocked(offerer, answerer, false)
+	s.established = true
+	h.mu.Unlock()
+	t.Cleanup(func() { s.ackTimer.Stop() })
+
+	return h, offerer, answerer
+}
+
+func collisions(c *Client) int {
+	n := 0
+	for len(c.send) > 0 {
+		if (<-c.send).Action == types.ActionOfferCollision {
+			n++
+		}
+	}
+	return n
+}
+
+func TestOfferCollision(t *testing.T) {
+	h, offerer, answerer := newTestSession(t)
+
+	if !h.offerFrom(answerer, offerer.ID) {
+		t.Fatal("first offer was dropped")
+	}
+	if !h.offerFrom(offerer, answerer.ID) {
+		t.Fatal("the offerer lost a collision")
+	}
+	if n := collisions(answerer); n != 1 {
+		t.Fatalf("answerer told of %d collisions, want 1", n)
+	}
+
+	// The answerer rolled back and answers, then both may offer again
+	h.answerFrom(answerer, offerer.ID)
+	if !h.offerFrom(answerer, offerer.ID) {
+		t.Fatal("offer after the answer was dropped")
+	}
+}
+
+func TestUnansweredOfferExpires(t *testing.T) {
+	h, offerer, answerer := newTestSession(t)
+
+	// The answerer never answers this one
+	if !h.offerFrom(offerer, answerer.ID) {
+		t.Fatal("offer was dropped")
+	}
+	if h.offerFrom(answerer, offerer.ID) {
+		t.Fatal("colliding offer of the answerer went through")
+	}
+	collisions(answerer)
+
+	h.mu.Lock()
+	s := h.sessions[offerer.SessionID]
+	s.offerPending[0] = s.offerPending[0].Add(-offerTimeout)
+	h.mu.Unlock()
+
+	if !h.offerFrom(answerer, offerer.ID) {
+		t.Fatal("offer was dropped for colliding with an expired one")
+	}
+	if n := collisions(answerer); n != 0 {
+		t.Fatalf("answerer told of %d collisions, want none", n)
+	}
+}
+
+func TestRollbackClearsPendingOffers(t *testing.T) {
+	h, offerer, answerer := newTestSession(t)
+
+	if !h.offerFrom(offerer, answerer.ID) {
+		t.Fatal("offer was dropped")
+	}
+
+	// The answerer rejects the offer
+	h.rollbackFrom(answerer, offerer.ID)
+
+	if !h.offerFrom(answerer, offerer.ID) {
+		t.Fatal("offer after a rollback was dropped")
+	}
+	if n := collisions(answerer); n != 0 {
+		t.Fatalf("answerer told of %d collisions, want none", n)
+	}
+}
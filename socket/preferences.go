@@ -0,0 +1,123 @@
+package socket
+
+import (
+	"errors"
+	"strings"
+)
+
+// Kinds of chat a client can start.
+const (
+	ModeVideo = "video"
+	ModeAudio = "audio"
+	ModeText  = "text"
+)
+
+// Limits on the languages a client can list.
+const (
+	maxLanguages      = 10
+	maxLanguageLength = 35
+)
+
+var (
+	ErrInvalidMode      = errors.New("mode must be video, audio or text")
+	ErrInvalidLanguages = errors.New("invalid languages")
+)
+
+// MatchFilter describes the partner a client is looking for. Empty fields
+// accept anyone. As a hard filter, a partner that doesn't pass it is never
+// paired; as a soft preference, it ranks after those that do.
+type MatchFilter struct {
+	// The partner speaks at least one of these
+	Languages []string `json:"languages,omitempty"`
+
+	// The partner wants this kind of chat
+	Mode string `json:"mode,omitempty"`
+}
+
+// normalize validates the request and brings its languages down to
+// lowercase primary subtags, so "en-US" and "en" match. The mode defaults
+// to video.
+func (r *StartChatRequest) normalize() error {
+	if r.Mode == "" {
+		r.Mode = ModeVideo
+	}
+	if !validMode(r.Mode) || !validMode(r.Require.Mode) || !validMode(r.Prefer.Mode) {
+		return ErrInvalidMode
+	}
+
+	var err error
+	for _, languages := range []*[]string{&r.Languages, &r.Require.Languages, &r.Prefer.Languages} {
+		if *languages, err = normalizeLanguages(*languages); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func validMode(mode string) bool {
+	switch mode {
+	case "", ModeVideo, ModeAudio, ModeText:
+		return true
+	}
+	return false
+}
+
+func normalizeLanguages(languages []string) ([]string, error) {
+	if len(languages) > maxLanguages {
+		return nil, ErrInvalidLanguages
+	}
+
+	var normalized []string
+	for _, tag := range languages {
+		if tag == "" || len(tag) > maxLanguageLength {
+			return nil, ErrInvalidLanguages
+		}
+		primary, _, _ := strings.Cut(strings.ReplaceAll(tag, "_", "-"), "-")
+		normalized = append(normalized, strings.ToLower(primary))
+	}
+	return normalized, nil
+}
+
+// passes reports whether the client c passes filter f.
+func (f *MatchFilter) passes(c *candidate) bool {
+	if f.Mode != "" && f.Mode != c.mode {
+		return false
+	}
+	return len(f.Languages) == 0 || sharesLanguage(f.Languages, c.languages)
+}
+
+// compatible reports whether two clients pass each other's hard filters.
+func compatible(a, b *candidate) bool {
+	return a.require.passes(b) && b.require.passes(a)
+}
+
+// preferencePenalty counts the soft preferences of either client the other
+// doesn't meet. Clients that both listed languages but share none, or want
+// different kinds of chat, count as missing a preference too.
+func preferencePenalty(a, b *candidate) int {
+	penalty := 0
+	if !a.prefer.passes(b) {
+		penalty++
+	}
+	if !b.prefer.passes(a) {
+		penalty++
+	}
+	if len(a.languages) > 0 && len(b.languages) > 0 && !sharesLanguage(a.languages, b.languages) {
+		penalty++
+	}
+	if a.mode != b.mode {
+		penalty++
+	}
+	return penalty
+}
+
+func sharesLanguage(a, b []string) bool {
+	for _, x := range a {
+		for _, y := range b {
+			if x == y {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,120 @@
+package socket
+
+import (
+	"math"
+	"time"
+
+	"github.com/saifwork/socket-service/responses"
+	"github.com/saifwork/socket-service/types"
+)
+
+// Presence levels a client can subscribe to. New clients get the active
+// user count; the stats level replaces it with PresenceStats.
+const (
+	PresenceLevelNone  = "none"
+	PresenceLevelCount = "count"
+	PresenceLevelStats = "stats"
+)
+
+type PresenceSubscription struct {
+	Level string `json:"level"`
+}
+
+// PresenceStats is sent to clients subscribed to the stats level.
+type PresenceStats struct {
+	ActiveUsers int `json:"activeUsers"`
+	Waiting     int `json:"waiting"`
+
+	// Expected seconds until a client joining the pool now is paired, -1
+	// when there were no recent pairings to estimate from.
+	EstimatedWait float64 `json:"estimatedWait"`
+}
+
+// SetPresence changes the presence level the client is subscribed to.
+func (h *Hub) SetPresence(client *Client, level string) bool {
+	switch level {
+	case PresenceLevelNone, PresenceLevelCount, PresenceLevelStats:
+	default:
+		return false
+	}
+
+	h.mu.Lock()
+	client.presence = level
+	h.mu.Unlock()
+	return true
+}
+
+// sendPresence sends the client the current presence update of the level it
+// is subscribed to.
+func (h *Hub) sendPresence(client *Client) {
+	h.mu.Lock()
+	level := client.presence
+	h.mu.Unlock()
+
+	switch level {
+	case PresenceLevelCount:
+		client.sendMessage(types.ActionActiveUsers, h.presenceStats().ActiveUsers)
+	case PresenceLevelStats:
+		client.sendMessage(types.ActionPresenceStats, h.presenceStats())
+	}
+}
+
+// presenceStats computes the current presence stats.
+func (h *Hub) presenceStats() PresenceStats {
+	stats := h.Stats()
+
+	wait := h.matches.estimateWait(stats.Waiting, time.Now())
+	estimated := -1.0
+	if wait >= 0 {
+		estimated = math.Round(wait.Seconds())
+	}
+
+	return PresenceStats{
+		ActiveUsers:   stats.Clients,
+		Waiting:       stats.Waiting,
+		EstimatedWait: estimated,
+	}
+}
+
+// broadcastPresence sends presence updates every presence interval, to the
+// clients subscribed to them and only when they changed. This coalesces
+// bursts of joins and leaves into a single update.
+func (h *Hub) broadcastPresence() {
+	lastCount, lastStats := -1, PresenceStats{ActiveUsers: -1}
+
+	go func() {
+		for range time.Tick(h.config.PresenceInterval) {
+			stats := h.presenceStats()
+
+			if stats.ActiveUsers != lastCount {
+				lastCount = stats.ActiveUsers
+				h.BroadcastUserCount()
+			}
+
+			if stats != lastStats {
+				lastStats = stats
+				mr := &MessageResponse{
+					Action:  types.ActionPresenceStats,
+					Message: responses.NewSuccessResponse(stats),
+				}
+				for _, client := range h.presenceSubscribers(PresenceLevelStats) {
+					h.deliver(client, mr)
+				}
+			}
+		}
+	}()
+}
+
+// presenceSubscribers returns the clients subscribed to the given level.
+func (h *Hub) presenceSubscribers(level string) []*Client {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	var clients []*Client
+	for client := range h.clients {
+		if client.presence == level && !client.detached {
+			clients = append(clients, client)
+		}
+	}
+	return clients
+}
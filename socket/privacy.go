@@ -0,0 +1,50 @@
+package socket
+
+import (
+	"log"
+
+	"github.com/saifwork/socket-service/metrics"
+	"github.com/saifwork/socket-service/sdp"
+)
+
+// ICE transport policies clients are told to create their peer connection
+// with, see RTCConfiguration.iceTransportPolicy.
+const (
+	IceTransportAll   = "all"
+	IceTransportRelay = "relay"
+)
+
+// private reports whether the client's addresses are kept from its peers,
+// because privacy mode is on for everyone or the client asked for it.
+func (c *Client) private() bool {
+	return c.hub.config.PrivacyMode || c.privacy
+}
+
+// iceTransportPolicy returns the ICE transport policy the client has to
+// use. Private clients may only gather relay candidates.
+func (c *Client) iceTransportPolicy() string {
+	if c.private() {
+		return IceTransportRelay
+	}
+	return IceTransportAll
+}
+
+// allowCandidate reports whether a candidate from the client may be
+// relayed. Private clients only get relay candidates through, with their
+// related address masked, whatever policy their peer connection actually
+// uses.
+func (c *Client) allowCandidate(ic *IceCandidate) bool {
+	if !c.private() || ic.IsEndOfCandidates() {
+		return true
+	}
+
+	typ := sdp.CandidateType(ic.Candidate)
+	if typ != sdp.CandidateRelay {
+		metrics.Inc("ice_candidates_dropped", "type", typ)
+		log.Printf("Dropped %s candidate from private client %s", typ, c.ID)
+		return false
+	}
+
+	ic.Candidate = sdp.MaskRelatedAddress(ic.Candidate)
+	return true
+}
@@ -0,0 +1,43 @@
+package socket
+
+import (
+	"math"
+	"time"
+
+	"github.com/saifwork/socket-service/types"
+)
+
+// QueueStatus tells a waiting client where it stands in the waiting pool.
+type QueueStatus struct {
+	// Position in the pool, 1 for the longest waiting client.
+	Position int `json:"position"`
+	PoolSize int `json:"poolSize"`
+
+	// Expected seconds until the client is paired, derived from the recent
+	// pairing rate, -1 when there were no recent pairings to estimate from.
+	EstimatedWait float64 `json:"estimatedWait"`
+}
+
+// broadcastQueueStatus periodically sends every waiting client its queue
+// status, so it knows the search is still going.
+func (h *Hub) broadcastQueueStatus() {
+	go func() {
+		for range time.Tick(h.config.QueueStatusInterval) {
+			waiting := h.GetWaitingClients()
+			now := time.Now()
+
+			for i, client := range waiting {
+				status := &QueueStatus{
+					Position:      i + 1,
+					PoolSize:      len(waiting),
+					EstimatedWait: -1,
+				}
+				if wait := h.matches.estimateWait(i, now); wait >= 0 {
+					status.EstimatedWait = math.Round(wait.Seconds())
+				}
+
+				client.sendMessage(types.ActionQueueStatus, status)
+			}
+		}
+	}()
+}
@@ -0,0 +1,92 @@
+package socket
+
+import (
+	"sync"
+	"time"
+)
+
+// recentPartners remembers, per uId, who a client was recently paired
+// with, so the matcher can avoid pairing them again right away. Entries
+// expire after ttl and each uId keeps at most size partners.
+type recentPartners struct {
+	mu        sync.Mutex
+	partners  map[string][]recentPartner
+	size      int
+	ttl       time.Duration
+	lastSweep time.Time
+}
+
+type recentPartner struct {
+	uid string
+	at  time.Time
+}
+
+func newRecentPartners(size int, ttl time.Duration) *recentPartners {
+	return &recentPartners{
+		partners: make(map[string][]recentPartner),
+		size:     size,
+		ttl:      ttl,
+	}
+}
+
+// record notes that a and b were paired at t.
+func (r *recentPartners) record(a, b string, t time.Time) {
+	if r.size <= 0 {
+		return
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.add(a, b, t)
+	r.add(b, a, t)
+
+	// Drop the uIds whose partners all expired now and then
+	if t.Sub(r.lastSweep) >= r.ttl {
+		r.lastSweep = t
+		for uid, partners := range r.partners {
+			if t.Sub(partners[len(partners)-1].at) >= r.ttl {
+				delete(r.partners, uid)
+			}
+		}
+	}
+}
+
+func (r *recentPartners) add(uid, partner string, t time.Time) {
+	partners := r.partners[uid]
+
+	// Keep a partner once, at its latest pairing
+	for i, p := range partners {
+		if p.uid == partner {
+			partners = append(partners[:i], partners[i+1:]...)
+			break
+		}
+	}
+
+	partners = append(partners, recentPartner{uid: partner, at: t})
+	if len(partners) > r.size {
+		partners = partners[len(partners)-r.size:]
+	}
+	r.partners[uid] = partners
+}
+
+// has reports whether a and b were paired within the TTL at now. The lists
+// of a and b are truncated on their own, so either one remembering the
+// other is enough.
+func (r *recentPartners) has(a, b string, now time.Time) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.within(a, b, now) || r.within(b, a, now)
+}
+
+// within reports whether partner is in the list of uid within the TTL at
+// now. Must be called with the lock held.
+func (r *recentPartners) within(uid, partner string, now time.Time) bool {
+	for _, p := range r.partners[uid] {
+		if p.uid == partner {
+			return now.Sub(p.at) < r.ttl
+		}
+	}
+	return false
+}
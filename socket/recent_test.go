@@ -0,0 +1,38 @@
+package socket
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRecentPartnersBothDirections(t *testing.T) {
+	r := newRecentPartners(2, time.Minute)
+	now := time.Now()
+
+	r.record("a", "b", now)
+	// a moves on, pushing b out of its list, while b still lists a
+	r.record("a", "c", now.Add(time.Second))
+	r.record("a", "d", now.Add(2*time.Second))
+
+	for _, pair := range [][2]string{{"a", "b"}, {"b", "a"}} {
+		if !r.has(pair[0], pair[1], now.Add(3*time.Second)) {
+			t.Errorf("has(%s, %s) is false while b still lists a", pair[0], pair[1])
+		}
+	}
+	if r.has("a", "b", now.Add(time.Minute)) {
+		t.Error("expired pairing still remembered")
+	}
+	if r.has("b", "c", now) {
+		t.Error("never paired clients remembered")
+	}
+}
+
+func TestRecentPartnersDisabled(t *testing.T) {
+	r := newRecentPartners(0, time.Minute)
+	now := time.Now()
+
+	r.record("a", "b", now)
+	if r.has("a", "b", now) || r.has("b", "a", now) {
+		t.Error("pairing remembered with no history")
+	}
+}
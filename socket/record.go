@@ -0,0 +1,38 @@
+package socket
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/saifwork/socket-service/history"
+	"github.com/saifwork/socket-service/metrics"
+)
+
+// How long saving a session record may take.
+const recordTimeout = 5 * time.Second
+
+// recordSession saves the record of an ended session in the background.
+func (h *Hub) recordSession(s *session, reason string) {
+	metrics.Inc("sessions_ended", "reason", reason)
+	if h.sessionStore == nil {
+		return
+	}
+
+	source := history.SourceInvite
+	if s.fromPool {
+		source = history.SourcePool
+	}
+	record := history.NewRecord(s.ID, s.clients[0].ID, s.clients[1].ID, source,
+		s.createdAt, s.connectedAt, time.Now(), reason)
+
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), recordTimeout)
+		defer cancel()
+
+		if err := h.sessionStore.Save(ctx, record); err != nil {
+			metrics.Inc("session_records_failed")
+			log.Printf("Failed to record session %s: %s", record.SessionID, err)
+		}
+	}()
+}
@@ -0,0 +1,100 @@
+package socket
+
+import (
+	"errors"
+	"math"
+	"net"
+	"time"
+
+	"github.com/saifwork/socket-service/geo"
+)
+
+// Longest region accepted from a client.
+const maxRegionLength = 64
+
+var ErrInvalidLocation = errors.New("invalid location")
+
+// StartChatRequest optionally tells where the client is, as a region such
+// as "EU" or as coarse coordinates, to be paired with a client nearby, and
+// who it is and is looking for, see preferences.go.
+type StartChatRequest struct {
+	Region string   `json:"region"`
+	Lat    *float64 `json:"lat"`
+	Lon    *float64 `json:"lon"`
+
+	Languages []string    `json:"languages"`
+	Mode      string      `json:"mode"`
+	Require   MatchFilter `json:"require"`
+	Prefer    MatchFilter `json:"prefer"`
+}
+
+// SetLocator makes clients that don't report a location be located from
+// their IP address. Must be called before Run.
+func (h *Hub) SetLocator(locator *geo.Locator) {
+	h.locator = locator
+}
+
+// locate returns the location of a client starting a chat: the one it
+// reported, or else the one of its IP address when a GeoIP database is
+// configured.
+func (h *Hub) locate(client *Client, req *StartChatRequest) (geo.Location, error) {
+	if len(req.Region) > maxRegionLength || (req.Lat == nil) != (req.Lon == nil) {
+		return geo.Location{}, ErrInvalidLocation
+	}
+
+	loc := geo.Location{Region: req.Region}
+	if req.Lat != nil {
+		if math.Abs(*req.Lat) > 90 || math.Abs(*req.Lon) > 180 {
+			return geo.Location{}, ErrInvalidLocation
+		}
+		loc.Lat, loc.Lon, loc.HasCoords = *req.Lat, *req.Lon, true
+	}
+
+	if !loc.Known() && h.locator != nil {
+		host, _, err := net.SplitHostPort(client.Addr)
+		if err != nil {
+			host = client.Addr
+		}
+		if ip := net.ParseIP(host); ip != nil {
+			loc, _ = h.locator.Lookup(ip)
+		}
+	}
+
+	return loc, nil
+}
+
+// proximity scores how close two waiting clients are, lower being closer,
+// and reports whether they are close enough to be paired given how long
+// the longer waiting one waited. Clients whose distance can't be told go
+// after known near ones but are always acceptable.
+func (h *Hub) proximity(a, b *candidate) (float64, bool) {
+	if !h.config.RegionMatching {
+		return 0, true
+	}
+
+	distance, known := geo.Distance(a.location, b.location)
+	if !known {
+		return math.MaxFloat64, true
+	}
+
+	waited := a.waited
+	if b.waited > waited {
+		waited = b.waited
+	}
+	return distance, distance <= h.searchRadius(waited)
+}
+
+// searchRadius returns how far, in km, to look for a partner of a client
+// that waited that long. It stays at RegionRadius within the wait budget,
+// then grows by RegionRadiusGrowth per second, and is unlimited once the
+// client waited RegionMaxWait.
+func (h *Hub) searchRadius(waited time.Duration) float64 {
+	switch {
+	case waited < h.config.RegionWaitBudget:
+		return h.config.RegionRadius
+	case waited >= h.config.RegionMaxWait:
+		return math.Inf(1)
+	default:
+		return h.config.RegionRadius + (waited-h.config.RegionWaitBudget).Seconds()*h.config.RegionRadiusGrowth
+	}
+}
@@ -0,0 +1,159 @@
+package socket
+
+import (
+	"errors"
+	"log"
+
+	"github.com/saifwork/socket-service/types"
+)
+
+// Longest room ID accepted from a client.
+const maxRoomIDLength = 64
+
+var (
+	ErrInvalidRoomID = errors.New("roomId must be 1 to 64 bytes long")
+	ErrRoomFull      = errors.New("room is full")
+	ErrNotRoomMember = errors.New("not a member of the room")
+)
+
+// Room is a named group of clients exchanging signaling messages with each
+// other, used for small mesh group calls.
+type Room struct {
+	ID string
+
+	// Members in join order
+	members []*Client
+}
+
+type RoomRequest struct {
+	ID string `json:"roomId"`
+}
+
+// RoomMembers is sent to every member when the room membership changes.
+type RoomMembers struct {
+	ID      string   `json:"roomId"`
+	Members []string `json:"members"`
+}
+
+func (r *Room) has(client *Client) bool {
+	for _, m := range r.members {
+		if m == client {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *Room) snapshot() *RoomMembers {
+	rm := &RoomMembers{ID: r.ID, Members: make([]string, 0, len(r.members))}
+	for _, m := range r.members {
+		rm.Members = append(rm.Members, m.ID)
+	}
+	return rm
+}
+
+// JoinRoom adds the client to the room, creating it when needed, and
+// broadcasts the new member list. A room is only created once the client
+// may join it, so that rejected joins don't leave empty rooms behind.
+func (h *Hub) JoinRoom(client *Client, roomID string) (*RoomMembers, error) {
+	if roomID == "" || len(roomID) > maxRoomIDLength {
+		return nil, ErrInvalidRoomID
+	}
+
+	h.roomsMu.Lock()
+	room, ok := h.rooms[roomID]
+	if !ok {
+		room = &Room{ID: roomID}
+	}
+
+	if room.has(client) {
+		rm := room.snapshot()
+		h.roomsMu.Unlock()
+		return rm, nil
+	}
+
+	if len(room.members) >= h.config.RoomCapacity {
+		h.roomsMu.Unlock()
+		return nil, ErrRoomFull
+	}
+
+	h.rooms[roomID] = room
+	room.members = append(room.members, client)
+	rm := room.snapshot()
+	members := append([]*Client(nil), room.members...)
+	h.roomsMu.Unlock()
+
+	log.Printf("Client %s joined room %s (%d members)", client.ID, roomID, len(members))
+	h.broadcastRoomMembers(members, rm)
+
+	return rm, nil
+}
+
+// LeaveRoom removes the client from the room and broadcasts the new member
+// list. Empty rooms are dropped.
+func (h *Hub) LeaveRoom(client *Client, roomID string) error {
+	h.roomsMu.Lock()
+	room, ok := h.rooms[roomID]
+	if !ok || !room.has(client) {
+		h.roomsMu.Unlock()
+		return ErrNotRoomMember
+	}
+
+	for i, m := range room.members {
+		if m == client {
+			room.members = append(room.members[:i], room.members[i+1:]...)
+			break
+		}
+	}
+	if len(room.members) == 0 {
+		delete(h.rooms, roomID)
+	}
+	rm := room.snapshot()
+	members := append([]*Client(nil), room.members...)
+	h.roomsMu.Unlock()
+
+	log.Printf("Client %s left room %s (%d members)", client.ID, roomID, len(members))
+	h.broadcastRoomMembers(members, rm)
+
+	return nil
+}
+
+// leaveAllRooms removes a client that is gone for good from every room.
+func (h *Hub) leaveAllRooms(client *Client) {
+	h.roomsMu.Lock()
+	var joined []string
+	for id, room := range h.rooms {
+		if room.has(client) {
+			joined = append(joined, id)
+		}
+	}
+	h.roomsMu.Unlock()
+
+	for _, id := range joined {
+		_ = h.LeaveRoom(client, id)
+	}
+}
+
+// InRoom reports whether the client with the given uId is a member of the
+// room.
+func (h *Hub) InRoom(roomID, uid string) bool {
+	h.roomsMu.Lock()
+	defer h.roomsMu.Unlock()
+
+	room, ok := h.rooms[roomID]
+	if !ok {
+		return false
+	}
+	for _, m := range room.members {
+		if m.ID == uid {
+			return true
+		}
+	}
+	return false
+}
+
+func (h *Hub) broadcastRoomMembers(members []*Client, rm *RoomMembers) {
+	for _, m := range members {
+		m.sendMessage(types.ActionRoomMembers, rm)
+	}
+}
@@ -0,0 +1,56 @@
+package socket
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/saifwork/socket-service/configs"
+)
+
+func newRoomClient(h *Hub, id string) *Client {
+	return &Client{hub: h, send: make(chan *MessageResponse, sendBufferSize), User: User{ID: id}}
+}
+
+func TestJoinRoomRejectedLeavesNoRoom(t *testing.T) {
+	tests := []struct {
+		name     string
+		capacity int
+		roomID   string
+		want     error
+	}{
+		{"no capacity", 0, "room", ErrRoomFull},
+		{"negative capacity", -1, "room", ErrRoomFull},
+		{"empty ID", 6, "", ErrInvalidRoomID},
+		{"long ID", 6, strings.Repeat("r", maxRoomIDLength+1), ErrInvalidRoomID},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := NewHub(&configs.Config{RoomCapacity: tt.capacity})
+			if _, err := h.JoinRoom(newRoomClient(h, "a"), tt.roomID); !errors.Is(err, tt.want) {
+				t.Fatalf("got %v, want %v", err, tt.want)
+			}
+			if len(h.rooms) != 0 {
+				t.Fatalf("%d rooms left behind", len(h.rooms))
+			}
+		})
+	}
+}
+
+func TestJoinRoomCapacity(t *testing.T) {
+	h := NewHub(&configs.Config{RoomCapacity: 2})
+	id := strings.Repeat("r", maxRoomIDLength)
+
+	for _, uid := range []string{"a", "b"} {
+		if _, err := h.JoinRoom(newRoomClient(h, uid), id); err != nil {
+			t.Fatalf("%s: %s", uid, err)
+		}
+	}
+	if _, err := h.JoinRoom(newRoomClient(h, "c"), id); !errors.Is(err, ErrRoomFull) {
+		t.Fatalf("got %v, want %v", err, ErrRoomFull)
+	}
+	if !h.InRoom(id, "a") || !h.InRoom(id, "b") || h.InRoom(id, "c") {
+		t.Fatal("members changed by a rejected join")
+	}
+}
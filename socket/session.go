@@ -0,0 +1,410 @@
+package socket
+
+import (
+	"errors"
+	"log"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/saifwork/socket-service/geo"
+	"github.com/saifwork/socket-service/turn"
+	"github.com/saifwork/socket-service/types"
+)
+
+var (
+	ErrInCall          = errors.New("already in a call")
+	ErrSessionNotFound = errors.New("match not found or expired")
+)
+
+// Reasons a pairing can end early, sent with match_cancelled.
+const (
+	CancelStopped    = "stopped"
+	CancelAckTimeout = "ack_timeout"
+	CancelPeerLeft   = "peer_left"
+)
+
+// Reasons a session ends once it is a call, or when one of its clients is
+// paired again, recorded in the session history.
+const (
+	EndDisconnected = "disconnected"
+	EndRematched    = "rematched"
+)
+
+// session is a pairing of two clients. Both get a match_found and must
+// accept it with a match_ack before the first one is asked for an offer.
+type session struct {
+	ID string
+
+	// The offerer first, then the answerer
+	clients   [2]*Client
+	createdAt time.Time
+
+	// Whether the clients came from the waiting pool, as opposed to an
+	// invite. Only pool clients go back to the pool when a pairing fails.
+	fromPool bool
+
+	// Which clients accepted the match, and the timer cancelling it when
+	// they don't in time.
+	accepted [2]bool
+	ackTimer *time.Timer
+
+	// Set once an answer went through, from then on the clients are in a
+	// call rather than being matched.
+	established bool
+	connectedAt time.Time
+
+	// When each client sent the offer it is waiting an answer for, zero
+	// when none, to detect offers crossing each other.
+	offerPending [2]time.Time
+}
+
+// MatchFound tells a client it was paired and has to accept the match, and
+// which side of the negotiation it is on.
+type MatchFound struct {
+	SessionID string `json:"sessionId"`
+	ID        string `json:"uId"`
+	Role      string `json:"role"`
+	Polite    bool   `json:"polite"`
+
+	// ICE transport policy the client has to use for this call
+	IceTransportPolicy string `json:"iceTransportPolicy"`
+
+	// TURN/STUN servers of the service with credentials for this client
+	IceServers []turn.ICEServer `json:"iceServers,omitempty"`
+}
+
+// MatchAck accepts a match.
+type MatchAck struct {
+	SessionID string `json:"sessionId"`
+}
+
+// CallEnded tells a client its call was ended by the server, e.g. because
+// its partner asked for a new match.
+type CallEnded struct {
+	ID     string `json:"uId"`
+	Reason string `json:"reason"`
+}
+
+// MatchCancelled tells a client its pairing was undone before the call was
+// set up.
+type MatchCancelled struct {
+	ID       string `json:"uId"`
+	Reason   string `json:"reason"`
+	Requeued bool   `json:"requeued"`
+}
+
+func (s *session) index(client *Client) int {
+	if s.clients[0] == client {
+		return 0
+	}
+	return 1
+}
+
+func (s *session) other(client *Client) *Client {
+	return s.clients[1-s.index(client)]
+}
+
+func (s *session) bothAccepted() bool {
+	return s.accepted[0] && s.accepted[1]
+}
+
+// linkLocked takes both clients out of the pool, links them in a new
+// session and starts the accept handshake timer. client1 is the offerer;
+// for pool matches it is whichever client waited longer, so roles don't
+// depend on how the matcher picked the pair. Must be called with the hub
+// lock held, and followed by announceMatch once it is released, after the
+// returned notifications.
+func (h *Hub) linkLocked(client1, client2 *Client, fromPool bool) (*session, []func()) {
+	if fromPool && waitedLonger(client2, client1) {
+		client1, client2 = client2, client1
+	}
+
+	// Callers settle previous sessions first, this only keeps a partner
+	// from being left behind when one is still there
+	var notify []func()
+	for _, client := range []*Client{client1, client2} {
+		notify = append(notify, h.leaveSessionLocked(client, EndRematched)...)
+	}
+
+	s := &session{
+		ID:        uuid.NewString(),
+		clients:   [2]*Client{client1, client2},
+		createdAt: time.Now(),
+		fromPool:  fromPool,
+	}
+	h.sessions[s.ID] = s
+
+	for _, client := range s.clients {
+		client.IsWaiting = false
+		client.requeued = false
+	}
+	client1.PartnerID, client1.SessionID = client2.ID, s.ID
+	client2.PartnerID, client2.SessionID = client1.ID, s.ID
+	client1.lastPartnerID, client2.lastPartnerID = client2.ID, client1.ID
+	h.recent.record(client1.ID, client2.ID, s.createdAt)
+
+	s.ackTimer = time.AfterFunc(h.config.MatchAckTimeout, func() {
+		h.handshakeTimeout(s)
+	})
+
+	return s, notify
+}
+
+// leaveSessionLocked takes the client out of its session, if any. A match
+// that isn't a call yet is cancelled, with the partner going back to the
+// pool; a call is ended with the given reason and the partner told. It
+// returns the notifications to send once the hub lock is released.
+func (h *Hub) leaveSessionLocked(client *Client, reason string) []func() {
+	s, ok := h.sessions[client.SessionID]
+	if !ok {
+		return nil
+	}
+
+	if !s.established {
+		return h.cancelMatchLocked(s, CancelStopped, func(c *Client) bool {
+			return c != client
+		})
+	}
+
+	h.unlinkLocked(s, reason)
+	partner := s.other(client)
+	return []func(){func() {
+		partner.sendMessage(types.ActionCallEnded, &CallEnded{ID: client.ID, Reason: reason})
+	}}
+}
+
+// announceMatch sends match_found to both clients of a new session, along
+// with their TURN credentials when the embedded server is enabled.
+func (h *Hub) announceMatch(s *session) {
+	for i, client := range s.clients {
+		var iceServers []turn.ICEServer
+		if h.turnServer != nil {
+			var err error
+			if iceServers, err = h.turnServer.Credentials(client.ID); err != nil {
+				log.Printf("Failed to issue TURN credentials to %s: %s", client.ID, err)
+			}
+		}
+
+		client.sendMessage(types.ActionMatchFound, &MatchFound{
+			SessionID: s.ID,
+			ID:        s.other(client).ID,
+			Role:      roleOf(i),
+			Polite:    i == 1,
+
+			IceTransportPolicy: client.iceTransportPolicy(),
+			IceServers:         iceServers,
+		})
+	}
+}
+
+// unlinkLocked ends the session, clears the partner of both clients and
+// records the session with the given end reason. Must be called with the
+// hub lock held.
+func (h *Hub) unlinkLocked(s *session, reason string) {
+	s.ackTimer.Stop()
+	delete(h.sessions, s.ID)
+	for _, client := range s.clients {
+		if client.SessionID == s.ID {
+			client.PartnerID, client.SessionID = "", ""
+		}
+	}
+
+	h.recordSession(s, reason)
+}
+
+// requeueLocked puts a client back in the waiting pool, ahead of the
+// clients that never got a match. Must be called with the hub lock held.
+func (h *Hub) requeueLocked(client *Client) {
+	client.IsWaiting = true
+	client.requeued = true
+}
+
+// cancelMatchLocked undoes a session that isn't a call yet. The clients
+// for which keep returns true go back to the pool when they came from it.
+// It returns the notifications to send once the hub lock is released.
+func (h *Hub) cancelMatchLocked(s *session, reason string, keep func(*Client) bool) []func() {
+	h.unlinkLocked(s, reason)
+
+	var notify []func()
+	for _, client := range s.clients {
+		if !keep(client) {
+			continue
+		}
+
+		requeued := s.fromPool
+		if requeued {
+			h.requeueLocked(client)
+		}
+
+		client, other := client, s.other(client)
+		notify = append(notify, func() {
+			client.sendMessage(types.ActionMatchCancelled, &MatchCancelled{
+				ID:       other.ID,
+				Reason:   reason,
+				Requeued: requeued,
+			})
+		})
+	}
+	return notify
+}
+
+// AcceptMatch records that the client accepted its match. Once both sides
+// did, the first client is asked for an offer.
+func (h *Hub) AcceptMatch(client *Client, sessionID string) error {
+	h.mu.Lock()
+	s, ok := h.sessions[sessionID]
+	if !ok || client.SessionID != sessionID {
+		h.mu.Unlock()
+		return ErrSessionNotFound
+	}
+
+	if s.bothAccepted() {
+		h.mu.Unlock()
+		return nil
+	}
+
+	s.accepted[s.index(client)] = true
+	ready := s.bothAccepted()
+	if ready {
+		s.ackTimer.Stop()
+	}
+	h.mu.Unlock()
+
+	if ready {
+		log.Printf("Match %s accepted by %s and %s", s.ID, s.clients[0].ID, s.clients[1].ID)
+		s.clients[0].sendConnectionRequest(s.clients[1].ID, types.ActionOfferReq)
+	}
+
+	return nil
+}
+
+// handshakeTimeout cancels a match that wasn't accepted by both sides in
+// time. The side that did accept is requeued at the front of the pool.
+func (h *Hub) handshakeTimeout(s *session) {
+	h.mu.Lock()
+	if _, ok := h.sessions[s.ID]; !ok || s.bothAccepted() {
+		h.mu.Unlock()
+		return
+	}
+
+	log.Printf("Match %s was not accepted in time", s.ID)
+	notify := h.cancelMatchLocked(s, CancelAckTimeout, func(client *Client) bool {
+		return s.accepted[s.index(client)]
+	})
+
+	// The side that didn't answer isn't requeued, but is told about it
+	for i, client := range s.clients {
+		if !s.accepted[i] {
+			client := client
+			notify = append(notify, func() {
+				client.sendMessage(types.ActionMatchCancelled, &MatchCancelled{
+					ID:     s.other(client).ID,
+					Reason: CancelAckTimeout,
+				})
+			})
+		}
+	}
+	h.mu.Unlock()
+
+	for _, n := range notify {
+		n()
+	}
+}
+
+// StartSearch puts the client in the waiting pool. A match it was still
+// waiting on is cancelled first, the partner going back to the pool, while
+// a client in a call has to end it before searching again.
+func (h *Hub) StartSearch(client *Client, location geo.Location, req *StartChatRequest) error {
+	h.mu.Lock()
+	if s, ok := h.sessions[client.SessionID]; ok && s.established {
+		h.mu.Unlock()
+		return ErrInCall
+	}
+
+	notify := h.leaveSessionLocked(client, CancelStopped)
+	client.IsWaiting = true
+	client.EnterAt = time.Now()
+	client.location = location
+	client.Languages, client.Mode = req.Languages, req.Mode
+	client.Require, client.Prefer = req.Require, req.Prefer
+	h.mu.Unlock()
+
+	for _, n := range notify {
+		n()
+	}
+	return nil
+}
+
+// StopSearch takes the client out of the waiting pool. It runs under the
+// hub lock, like pairing does, so the two are ordered: when the client was
+// matched just before, the match is undone and the partner goes back to
+// the pool. Stopping always wins over a match that isn't a call yet.
+func (h *Hub) StopSearch(client *Client) error {
+	h.mu.Lock()
+
+	if client.IsWaiting {
+		client.IsWaiting = false
+		client.requeued = false
+		h.mu.Unlock()
+		log.Printf("Client %s stopped searching", client.ID)
+		return nil
+	}
+
+	s, ok := h.sessions[client.SessionID]
+	if !ok {
+		// Nothing to stop
+		h.mu.Unlock()
+		return nil
+	}
+	if s.established {
+		h.mu.Unlock()
+		return ErrInCall
+	}
+
+	notify := h.cancelMatchLocked(s, CancelStopped, func(c *Client) bool {
+		return c != client
+	})
+	h.mu.Unlock()
+
+	log.Printf("Client %s stopped searching, cancelling its match with %s", client.ID, s.other(client).ID)
+	for _, n := range notify {
+		n()
+	}
+
+	return nil
+}
+
+// waitedLonger reports whether a entered the pool before b, using the uId
+// to break ties.
+func waitedLonger(a, b *Client) bool {
+	if !a.EnterAt.Equal(b.EnterAt) {
+		return a.EnterAt.Before(b.EnterAt)
+	}
+	return a.ID < b.ID
+}
+
+// removed cleans up after a client that left for good. A match that isn't
+// a call yet is cancelled, with the partner going back to the pool.
+func (h *Hub) removed(client *Client) {
+	var notify []func()
+
+	h.mu.Lock()
+	if s, ok := h.sessions[client.SessionID]; ok {
+		if s.established {
+			h.unlinkLocked(s, EndDisconnected)
+		} else {
+			notify = h.cancelMatchLocked(s, CancelPeerLeft, func(c *Client) bool {
+				return c != client
+			})
+		}
+	}
+	h.mu.Unlock()
+
+	for _, n := range notify {
+		n()
+	}
+
+	h.leaveAllRooms(client)
+	h.dropInvites(client)
+	h.blocks.forget(client.ID)
+}
@@ -0,0 +1,123 @@
+package socket
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/saifwork/socket-service/configs"
+	"github.com/saifwork/socket-service/geo"
+	"github.com/saifwork/socket-service/responses"
+	"github.com/saifwork/socket-service/types"
+)
+
+// received drains the messages queued for the client, by action.
+func received(c *Client) map[string][]*MessageResponse {
+	got := make(map[string][]*MessageResponse)
+	for len(c.send) > 0 {
+		mr := <-c.send
+		got[mr.Action] = append(got[mr.Action], mr)
+	}
+	return got
+}
+
+// payload returns the data of a success response.
+func payload(mr *MessageResponse) any {
+	return mr.Message.(*responses.ResponseDto).Data
+}
+
+// newPoolMatch pairs two clients taken from the waiting pool, a having
+// waited longer.
+func newPoolMatch(t *testing.T) (*Hub, *Client, *Client) {
+	t.Helper()
+
+	h := NewHub(&configs.Config{MatchAckTimeout: time.Minute})
+	a := newRoomClient(h, "a")
+	b := newRoomClient(h, "b")
+	a.EnterAt = time.Now().Add(-time.Second)
+	b.EnterAt = time.Now()
+	a.IsWaiting, b.IsWaiting = true, true
+
+	if !h.pairWaiting(a, b) {
+		t.Fatal("a and b were not paired")
+	}
+	t.Cleanup(func() {
+		h.mu.Lock()
+		for _, s := range h.sessions {
+			s.ackTimer.Stop()
+		}
+		h.mu.Unlock()
+	})
+	received(a)
+	received(b)
+	return h, a, b
+}
+
+func TestStartSearchCancelsPendingMatch(t *testing.T) {
+	h, a, b := newPoolMatch(t)
+	if err := h.AcceptMatch(b, b.SessionID); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := h.StartSearch(a, geo.Location{}, &StartChatRequest{}); err != nil {
+		t.Fatal(err)
+	}
+
+	got := received(b)[types.ActionMatchCancelled]
+	if len(got) != 1 {
+		t.Fatalf("partner got %d match_cancelled, want 1", len(got))
+	}
+	if mc := payload(got[0]).(*MatchCancelled); mc.ID != a.ID || !mc.Requeued {
+		t.Fatalf("partner got %+v, want a requeued cancel from a", mc)
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if !b.IsWaiting || b.SessionID != "" || b.PartnerID != "" {
+		t.Fatalf("partner left with waiting=%t session=%q partner=%q", b.IsWaiting, b.SessionID, b.PartnerID)
+	}
+	if !a.IsWaiting || a.SessionID != "" {
+		t.Fatalf("client left with waiting=%t session=%q", a.IsWaiting, a.SessionID)
+	}
+	if len(h.sessions) != 0 {
+		t.Fatalf("%d sessions left", len(h.sessions))
+	}
+}
+
+func TestStartSearchInCall(t *testing.T) {
+	h, a, b := newPoolMatch(t)
+	h.mu.Lock()
+	h.sessions[a.SessionID].established = true
+	h.mu.Unlock()
+
+	if err := h.StartSearch(a, geo.Location{}, &StartChatRequest{}); !errors.Is(err, ErrInCall) {
+		t.Fatalf("got %v, want %v", err, ErrInCall)
+	}
+	if a.IsWaiting || a.PartnerID != b.ID {
+		t.Fatal("a client in a call went back to the pool")
+	}
+}
+
+func TestRematchEndsCall(t *testing.T) {
+	h, a, b := newPoolMatch(t)
+	c := newRoomClient(h, "c")
+
+	h.mu.Lock()
+	h.sessions[a.SessionID].established = true
+	_, notify := h.linkLocked(a, c, false)
+	h.mu.Unlock()
+	for _, n := range notify {
+		n()
+	}
+
+	got := received(b)[types.ActionCallEnded]
+	if len(got) != 1 {
+		t.Fatalf("partner got %d call_ended, want 1", len(got))
+	}
+	if ce := payload(got[0]).(*CallEnded); ce.ID != a.ID || ce.Reason != EndRematched {
+		t.Fatalf("partner got %+v", ce)
+	}
+	if b.SessionID != "" || b.PartnerID != "" {
+		t.Fatal("partner still linked to the ended call")
+	}
+}
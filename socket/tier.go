@@ -0,0 +1,99 @@
+package socket
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/saifwork/socket-service/auth"
+)
+
+var (
+	ErrTokenRequired    = errors.New("a token is required")
+	ErrTokenSubject     = errors.New("token was not issued to this uId")
+	ErrFiltersForbidden = errors.New("hard filters are not available on your tier")
+)
+
+// SetVerifier makes clients be authenticated with the tokens they connect
+// with, and get the tier these carry. Must be called before Run.
+func (h *Hub) SetVerifier(verifier *auth.Verifier) {
+	h.verifier = verifier
+}
+
+// authenticate verifies the token a connecting uId presents, in the token
+// query parameter or as a bearer token, and returns its tier. Clients
+// without a token get the default tier, unless a token is required. On
+// failure it also returns the HTTP status to reject the connection with.
+func (h *Hub) authenticate(r *http.Request, uid string) (string, int, error) {
+	token := r.URL.Query().Get("token")
+	if token == "" {
+		if bearer, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok {
+			token = strings.TrimSpace(bearer)
+		}
+	}
+
+	if token == "" {
+		if h.config.AuthRequired {
+			return "", http.StatusUnauthorized, ErrTokenRequired
+		}
+		return h.config.TierDefault, 0, nil
+	}
+	if h.verifier == nil {
+		return "", http.StatusUnauthorized, auth.ErrInvalidToken
+	}
+
+	claims, err := h.verifier.Verify(token)
+	if err != nil {
+		return "", http.StatusUnauthorized, err
+	}
+	if claims.Subject != "" && claims.Subject != uid {
+		return "", http.StatusForbidden, ErrTokenSubject
+	}
+
+	return h.tierOf(claims.Tier), 0, nil
+}
+
+// tierOf returns the tier a client is matched on, the default one for
+// tiers that aren't configured.
+func (h *Hub) tierOf(tier string) string {
+	if _, ok := h.config.TierWeights[tier]; !ok {
+		return h.config.TierDefault
+	}
+	return tier
+}
+
+// tierWeight returns how much more likely than a weight 1 client a client
+// of the tier is to be paired first.
+func (h *Hub) tierWeight(tier string) float64 {
+	if w, ok := h.config.TierWeights[tier]; ok {
+		return w
+	}
+	return 1
+}
+
+// filtersAllowed reports whether clients of the tier may set hard filters.
+// Without authentication there are no tiers to tell apart, so everyone
+// may.
+func (h *Hub) filtersAllowed(tier string) bool {
+	if !h.config.AuthEnabled() {
+		return true
+	}
+	for _, t := range h.config.TierFilterAccess {
+		if t == "*" || t == tier {
+			return true
+		}
+	}
+	return false
+}
+
+// checkFilters rejects hard filters from clients whose tier doesn't give
+// access to them. Soft preferences are open to every tier.
+func (h *Hub) checkFilters(tier string, req *StartChatRequest) error {
+	if h.filtersAllowed(tier) {
+		return nil
+	}
+	if len(req.Require.Languages) > 0 || req.Require.Mode != "" {
+		return ErrFiltersForbidden
+	}
+	return nil
+}
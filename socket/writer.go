@@ -0,0 +1,84 @@
+package socket
+
+import (
+	"log"
+
+	"github.com/gorilla/websocket"
+	"github.com/saifwork/socket-service/metrics"
+)
+
+// Maximum number of queued messages coalesced into one frame.
+const maxBatchSize = 64
+
+// frameWriter writes outbound messages to one connection. Clients that
+// negotiated batching get all the messages of a write in a single frame
+// holding an array; others get one frame per message.
+type frameWriter struct {
+	conn  *websocket.Conn
+	codec Codec
+
+	// Frames of at least this many bytes are compressed, when the peer
+	// negotiated compression.
+	threshold int
+
+	batch bool
+}
+
+// write sends the messages. A message that fails to encode is logged,
+// counted as dropped and skipped, without taking the others down with it.
+func (w *frameWriter) write(messages []*MessageResponse) error {
+	if w.batch {
+		data, err := w.codec.Marshal(messages)
+		if err != nil {
+			log.Printf("Failed to encode a batch of %d messages, encoding them one by one: %s", len(messages), err)
+			if messages = w.encodable(messages); len(messages) == 0 {
+				return nil
+			}
+			if data, err = w.codec.Marshal(messages); err != nil {
+				log.Printf("Failed to encode a batch of %d messages: %s", len(messages), err)
+				for _, mr := range messages {
+					dropUnencodable(mr)
+				}
+				return nil
+			}
+		}
+		return w.writeFrame(data)
+	}
+
+	for _, mr := range messages {
+		data, err := w.codec.Marshal(mr)
+		if err != nil {
+			log.Printf("Failed to encode %s message: %s", mr.Action, err)
+			dropUnencodable(mr)
+			continue
+		}
+		if err := w.writeFrame(data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// encodable returns the messages that encode on their own, dropping the
+// others.
+func (w *frameWriter) encodable(messages []*MessageResponse) []*MessageResponse {
+	kept := make([]*MessageResponse, 0, len(messages))
+	for _, mr := range messages {
+		if _, err := w.codec.Marshal(mr); err != nil {
+			log.Printf("Failed to encode %s message: %s", mr.Action, err)
+			dropUnencodable(mr)
+			continue
+		}
+		kept = append(kept, mr)
+	}
+	return kept
+}
+
+func dropUnencodable(mr *MessageResponse) {
+	metrics.Inc("messages_dropped", "class", string(classOf(mr.Action)), "reason", "encode")
+}
+
+func (w *frameWriter) writeFrame(data []byte) error {
+	w.conn.EnableWriteCompression(len(data) >= w.threshold)
+	return w.conn.WriteMessage(w.codec.MessageType(), data)
+}
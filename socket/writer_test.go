@@ -0,0 +1,163 @@
+package socket
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/saifwork/socket-service/metrics"
+	"github.com/saifwork/socket-service/types"
+)
+
+// wsPair returns the server side of a websocket connection, along with the
+// frames its client side reads. Frames nobody waits for are discarded.
+func wsPair(tb testing.TB) (*websocket.Conn, <-chan []byte) {
+	tb.Helper()
+
+	conns := make(chan *websocket.Conn, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			tb.Error(err)
+			return
+		}
+		conns <- conn
+	}))
+	tb.Cleanup(srv.Close)
+
+	client, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http"), nil)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	tb.Cleanup(func() { _ = client.Close() })
+
+	frames := make(chan []byte, 16)
+	go func() {
+		for {
+			_, r, err := client.NextReader()
+			if err != nil {
+				return
+			}
+			data, err := io.ReadAll(r)
+			if err != nil {
+				return
+			}
+			select {
+			case frames <- data:
+			default:
+			}
+		}
+	}()
+
+	conn := <-conns
+	tb.Cleanup(func() { _ = conn.Close() })
+	return conn, frames
+}
+
+// unencodable is a presence message JSON can't encode.
+func unencodable() *MessageResponse {
+	return &MessageResponse{Action: types.ActionActiveUsers, Message: math.NaN()}
+}
+
+func nextFrame(t *testing.T, frames <-chan []byte) []byte {
+	t.Helper()
+
+	select {
+	case data := <-frames:
+		return data
+	case <-time.After(2 * time.Second):
+		t.Fatal("no frame received")
+		return nil
+	}
+}
+
+func TestFrameWriterSkipsUnencodable(t *testing.T) {
+	queue := []*MessageResponse{
+		{Action: types.ActionAnswerReq, Message: "answer"},
+		unencodable(),
+		{Action: types.ActionIceCandidateRec, Message: "candidate"},
+	}
+	dropped := func() int64 {
+		return metrics.Get("messages_dropped", "class", string(classPresence), "reason", "encode")
+	}
+
+	for _, batch := range []bool{false, true} {
+		t.Run(fmt.Sprintf("batch=%t", batch), func(t *testing.T) {
+			conn, frames := wsPair(t)
+			w := &frameWriter{conn: conn, codec: jsonCodec{}, threshold: 512, batch: batch}
+
+			before := dropped()
+			if err := w.write(queue); err != nil {
+				t.Fatal(err)
+			}
+			if got := dropped() - before; got != 1 {
+				t.Errorf("%d messages counted as dropped, want 1", got)
+			}
+
+			var got []MessageRequest
+			if batch {
+				if err := json.Unmarshal(nextFrame(t, frames), &got); err != nil {
+					t.Fatal(err)
+				}
+			} else {
+				for i := 0; i < 2; i++ {
+					var mr MessageRequest
+					if err := json.Unmarshal(nextFrame(t, frames), &mr); err != nil {
+						t.Fatal(err)
+					}
+					got = append(got, mr)
+				}
+			}
+			if len(got) != 2 || got[0].Action != types.ActionAnswerReq || got[1].Action != types.ActionIceCandidateRec {
+				t.Fatalf("received %+v, want the answer and the candidate", got)
+			}
+		})
+	}
+}
+
+// BenchmarkFrameWriter writes the same queue of signaling messages one
+// frame per message, and batched into a single frame.
+func BenchmarkFrameWriter(b *testing.B) {
+	candidate := "candidate:842163049 1 udp 1677729535 203.0.113.5 54321 typ srflx raddr 0.0.0.0 rport 0 generation 0 ufrag EsAw network-id 1"
+	mid := "0"
+	queue := make([]*MessageResponse, 16)
+	for i := range queue {
+		queue[i] = &MessageResponse{
+			Action:  "ice_candidate_rec",
+			Message: &IceCandidate{ID: "peer", Candidate: candidate, SdpMid: &mid},
+		}
+	}
+
+	for _, batch := range []bool{false, true} {
+		name := "per-message"
+		if batch {
+			name = "batched"
+		}
+
+		b.Run(name, func(b *testing.B) {
+			conn, _ := wsPair(b)
+			w := &frameWriter{
+				conn:      conn,
+				codec:     jsonCodec{},
+				threshold: 512,
+				batch:     batch,
+			}
+
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if err := w.write(queue); err != nil {
+					b.Fatal(err)
+				}
+			}
+			b.ReportMetric(float64(b.N*len(queue))/b.Elapsed().Seconds(), "msgs/s")
+		})
+	}
+}
@@ -0,0 +1,63 @@
+package sqldb
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+
+	_ "github.com/lib/pq"
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// Dialect is what differs between the SQL databases the stores support.
+type Dialect struct {
+	Driver    string
+	Timestamp string
+
+	// placeholder returns the placeholder of the nth query argument
+	placeholder func(n int) string
+}
+
+var (
+	SQLite = Dialect{
+		Driver:      "sqlite3",
+		Timestamp:   "TIMESTAMP",
+		placeholder: func(int) string { return "?" },
+	}
+	Postgres = Dialect{
+		Driver:      "postgres",
+		Timestamp:   "TIMESTAMPTZ",
+		placeholder: func(n int) string { return fmt.Sprintf("$%d", n) },
+	}
+)
+
+// Open opens the database at dsn and runs migrate on it, closing it again
+// when that fails.
+func Open(d Dialect, dsn string, migrate func(*sql.DB) error) (*sql.DB, error) {
+	db, err := sql.Open(d.Driver, dsn)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := migrate(db); err != nil {
+		_ = db.Close()
+		return nil, err
+	}
+	return db, nil
+}
+
+// Placeholder returns the placeholder of the nth query argument, counting
+// from 1.
+func (d Dialect) Placeholder(n int) string {
+	return d.placeholder(n)
+}
+
+// Placeholders returns the comma separated placeholders of arguments from
+// to to, inclusive.
+func (d Dialect) Placeholders(from, to int) string {
+	p := make([]string, 0, to-from+1)
+	for n := from; n <= to; n++ {
+		p = append(p, d.placeholder(n))
+	}
+	return strings.Join(p, ", ")
+}
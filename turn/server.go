@@ -0,0 +1,252 @@
+// Package turn runs a TURN/STUN server embedded in the service, for
+// deployments that can't run one alongside it. Clients get short-lived
+// credentials with their match, and allocations are only granted to
+// clients that are currently paired.
+package turn
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/pion/logging"
+	pionturn "github.com/pion/turn/v4"
+	"github.com/saifwork/socket-service/configs"
+	"github.com/saifwork/socket-service/metrics"
+)
+
+var errQuotaReached = errors.New("allocation quota reached")
+
+// ICEServer is an entry of RTCConfiguration.iceServers.
+type ICEServer struct {
+	URLs       []string `json:"urls"`
+	Username   string   `json:"username,omitempty"`
+	Credential string   `json:"credential,omitempty"`
+}
+
+// Server is the embedded TURN server.
+type Server struct {
+	config *configs.Config
+	server *pionturn.Server
+	secret string
+	urls   []string
+
+	// Active allocations, capped at TURNMaxAllocations
+	allocations atomic.Int64
+}
+
+// NewServer starts a TURN server listening on UDP and TCP. authorized
+// tells whether the client with the given uId may use the server, it is
+// checked on every authenticated request.
+func NewServer(config *configs.Config, authorized func(uId string) bool) (*Server, error) {
+	s := &Server{config: config, secret: config.TURNSecret}
+	if s.secret == "" {
+		// Only this process hands out credentials, any secret will do
+		b := make([]byte, 32)
+		if _, err := rand.Read(b); err != nil {
+			return nil, err
+		}
+		s.secret = hex.EncodeToString(b)
+	}
+
+	publicIP := net.ParseIP(config.TURNPublicIP)
+	if publicIP == nil {
+		return nil, fmt.Errorf("invalid TURN public IP %q", config.TURNPublicIP)
+	}
+
+	_, port, err := net.SplitHostPort(config.TURNListenAddr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid TURN listen address: %w", err)
+	}
+
+	s.urls = config.TURNURLs
+	if len(s.urls) == 0 {
+		hostPort := net.JoinHostPort(publicIP.String(), port)
+		s.urls = []string{
+			"stun:" + hostPort,
+			"turn:" + hostPort + "?transport=udp",
+			"turn:" + hostPort + "?transport=tcp",
+		}
+	}
+
+	udpConn, err := net.ListenPacket("udp", config.TURNListenAddr)
+	if err != nil {
+		return nil, err
+	}
+	tcpListener, err := net.Listen("tcp", config.TURNListenAddr)
+	if err != nil {
+		_ = udpConn.Close()
+		return nil, err
+	}
+
+	loggerFactory := logging.NewDefaultLoggerFactory()
+	longTerm := pionturn.LongTermTURNRESTAuthHandler(s.secret, loggerFactory.NewLogger("turn"))
+
+	s.server, err = pionturn.NewServer(pionturn.ServerConfig{
+		Realm:         config.TURNRealm,
+		LoggerFactory: loggerFactory,
+		AuthHandler: func(username, realm string, srcAddr net.Addr) ([]byte, bool) {
+			key, ok := longTerm(username, realm, srcAddr)
+			if !ok {
+				metrics.Inc("turn_auth_failures", "reason", "credentials")
+				return nil, false
+			}
+
+			// Usernames are <expiry>:<uId>
+			_, uId, _ := strings.Cut(username, ":")
+			if !authorized(uId) {
+				metrics.Inc("turn_auth_failures", "reason", "not_paired")
+				return nil, false
+			}
+			return key, true
+		},
+		PacketConnConfigs: []pionturn.PacketConnConfig{{
+			PacketConn:            udpConn,
+			RelayAddressGenerator: s.relayAddressGenerator(publicIP),
+			PermissionHandler:     s.permitPeer,
+		}},
+		ListenerConfigs: []pionturn.ListenerConfig{{
+			Listener:              tcpListener,
+			RelayAddressGenerator: s.relayAddressGenerator(publicIP),
+			PermissionHandler:     s.permitPeer,
+		}},
+	})
+	if err != nil {
+		_ = udpConn.Close()
+		_ = tcpListener.Close()
+		return nil, err
+	}
+
+	log.Printf("Serving TURN at %s, relaying on %s ports %d-%d", config.TURNListenAddr, publicIP, config.TURNRelayMinPort, config.TURNRelayMaxPort)
+	return s, nil
+}
+
+// Credentials returns the ICE servers to give the client, with
+// credentials expiring after the configured TTL.
+func (s *Server) Credentials(uId string) ([]ICEServer, error) {
+	username, password, err := pionturn.GenerateLongTermTURNRESTCredentials(s.secret, uId, s.config.TURNCredentialTTL)
+	if err != nil {
+		return nil, err
+	}
+
+	return []ICEServer{{
+		URLs:       s.urls,
+		Username:   username,
+		Credential: password,
+	}}, nil
+}
+
+// Close stops the server and its allocations.
+func (s *Server) Close() error {
+	return s.server.Close()
+}
+
+// permitPeer decides which peers clients may relay to. Loopback, private
+// and link-local addresses are refused unless TURNAllowPrivatePeers, so the
+// server can't be used to reach the network it runs in.
+func (s *Server) permitPeer(clientAddr net.Addr, peerIP net.IP) bool {
+	if s.config.TURNAllowPrivatePeers || publicPeer(peerIP) {
+		return true
+	}
+
+	log.Printf("Refused TURN permission from %s to %s", clientAddr, peerIP)
+	metrics.Inc("turn_permissions_denied")
+	return false
+}
+
+func publicPeer(ip net.IP) bool {
+	return !ip.IsLoopback() && !ip.IsPrivate() && !ip.IsUnspecified() &&
+		!ip.IsLinkLocalUnicast() && !ip.IsLinkLocalMulticast() && !ip.IsInterfaceLocalMulticast()
+}
+
+func (s *Server) relayAddressGenerator(publicIP net.IP) pionturn.RelayAddressGenerator {
+	return &quotaGenerator{
+		RelayAddressGenerator: &pionturn.RelayAddressGeneratorPortRange{
+			RelayAddress: publicIP,
+			Address:      "0.0.0.0",
+			MinPort:      uint16(s.config.TURNRelayMinPort),
+			MaxPort:      uint16(s.config.TURNRelayMaxPort),
+		},
+		server: s,
+	}
+}
+
+// quotaGenerator caps the number of allocations and wraps their relay
+// connections to count and cap the traffic they carry.
+type quotaGenerator struct {
+	pionturn.RelayAddressGenerator
+	server *Server
+}
+
+func (g *quotaGenerator) AllocatePacketConn(network string, requestedPort int) (net.PacketConn, net.Addr, error) {
+	s := g.server
+	if n := s.allocations.Add(1); s.config.TURNMaxAllocations > 0 && n > int64(s.config.TURNMaxAllocations) {
+		s.allocations.Add(-1)
+		metrics.Inc("turn_allocations_rejected", "reason", "quota")
+		return nil, nil, errQuotaReached
+	}
+
+	conn, addr, err := g.RelayAddressGenerator.AllocatePacketConn(network, requestedPort)
+	if err != nil {
+		s.allocations.Add(-1)
+		metrics.Inc("turn_allocations_rejected", "reason", "ports")
+		return nil, nil, err
+	}
+
+	metrics.Inc("turn_allocations")
+	metrics.Add("turn_allocations_active", 1)
+	return &relayConn{PacketConn: conn, server: s}, addr, nil
+}
+
+// relayConn is the relay side of an allocation. Traffic is counted in
+// metrics, and the allocation is closed once it relayed more than the
+// per-allocation quota.
+type relayConn struct {
+	net.PacketConn
+	server *Server
+
+	relayed   atomic.Int64
+	closeOnce sync.Once
+}
+
+// ReadFrom reads what peers send to the client.
+func (c *relayConn) ReadFrom(p []byte) (int, net.Addr, error) {
+	n, addr, err := c.PacketConn.ReadFrom(p)
+	if n > 0 {
+		metrics.Add("turn_bytes_relayed", int64(n), "direction", "in")
+		c.account(n)
+	}
+	return n, addr, err
+}
+
+// WriteTo writes what the client sends to a peer.
+func (c *relayConn) WriteTo(p []byte, addr net.Addr) (int, error) {
+	n, err := c.PacketConn.WriteTo(p, addr)
+	if n > 0 {
+		metrics.Add("turn_bytes_relayed", int64(n), "direction", "out")
+		c.account(n)
+	}
+	return n, err
+}
+
+func (c *relayConn) account(n int) {
+	quota := c.server.config.TURNAllocationQuota
+	if quota > 0 && c.relayed.Add(int64(n)) > quota {
+		metrics.Inc("turn_allocations_closed", "reason", "quota")
+		_ = c.Close()
+	}
+}
+
+func (c *relayConn) Close() error {
+	c.closeOnce.Do(func() {
+		c.server.allocations.Add(-1)
+		metrics.Add("turn_allocations_active", -1)
+	})
+	return c.PacketConn.Close()
+}
@@ -0,0 +1,189 @@
+package turn
+
+import (
+	"bytes"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/pion/logging"
+	pionturn "github.com/pion/turn/v4"
+	"github.com/saifwork/socket-service/configs"
+)
+
+// startServer runs a TURN server on a free loopback port. Only uIds for
+// which authorized returns true may allocate.
+func startServer(t *testing.T, allowPrivate bool, authorized func(string) bool) (*Server, string) {
+	t.Helper()
+
+	probe, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := probe.LocalAddr().String()
+	_ = probe.Close()
+
+	s, err := NewServer(&configs.Config{
+		TURNListenAddr:        addr,
+		TURNPublicIP:          "127.0.0.1",
+		TURNRelayMinPort:      50000,
+		TURNRelayMaxPort:      50999,
+		TURNRealm:             "test",
+		TURNCredentialTTL:     time.Minute,
+		TURNAllowPrivatePeers: allowPrivate,
+	}, authorized)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = s.Close() })
+
+	return s, addr
+}
+
+// newClient returns a TURN client of uId logged in with the credentials the
+// server hands out.
+func newClient(t *testing.T, s *Server, addr, uId string) *pionturn.Client {
+	t.Helper()
+
+	servers, err := s.Credentials(uId)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	conn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = conn.Close() })
+
+	client, err := pionturn.NewClient(&pionturn.ClientConfig{
+		STUNServerAddr: addr,
+		TURNServerAddr: addr,
+		Conn:           conn,
+		Username:       servers[0].Username,
+		Password:       servers[0].Credential,
+		Realm:          "test",
+		LoggerFactory:  logging.NewDefaultLoggerFactory(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(client.Close)
+
+	if err := client.Listen(); err != nil {
+		t.Fatal(err)
+	}
+	return client
+}
+
+// echoPeer answers every datagram with the same payload.
+func echoPeer(t *testing.T) net.PacketConn {
+	t.Helper()
+
+	peer, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = peer.Close() })
+
+	go func() {
+		buf := make([]byte, 1500)
+		for {
+			n, from, err := peer.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			_, _ = peer.WriteTo(buf[:n], from)
+		}
+	}()
+	return peer
+}
+
+func TestRelayToPeer(t *testing.T) {
+	s, addr := startServer(t, true, func(string) bool { return true })
+	client := newClient(t, s, addr, "alice")
+	peer := echoPeer(t)
+
+	relay, err := client.Allocate()
+	if err != nil {
+		t.Fatalf("allocate: %s", err)
+	}
+	defer relay.Close()
+
+	payload := []byte("hello through the relay")
+	buf := make([]byte, 1500)
+
+	// The first packets may be lost while the permission is set up
+	for attempt := 0; attempt < 10; attempt++ {
+		if _, err := relay.WriteTo(payload, peer.LocalAddr()); err != nil {
+			t.Fatalf("write: %s", err)
+		}
+
+		_ = relay.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+		n, from, err := relay.ReadFrom(buf)
+		if err != nil {
+			continue
+		}
+		if !bytes.Equal(buf[:n], payload) {
+			t.Fatalf("relayed %q, want %q", buf[:n], payload)
+		}
+		if from.String() != peer.LocalAddr().String() {
+			t.Fatalf("relayed from %s, want %s", from, peer.LocalAddr())
+		}
+		return
+	}
+	t.Fatal("nothing came back through the relay")
+}
+
+func TestPrivatePeerRefused(t *testing.T) {
+	s, addr := startServer(t, false, func(string) bool { return true })
+	client := newClient(t, s, addr, "alice")
+	peer := echoPeer(t)
+
+	relay, err := client.Allocate()
+	if err != nil {
+		t.Fatalf("allocate: %s", err)
+	}
+	defer relay.Close()
+
+	if err := client.CreatePermission(peer.LocalAddr()); err == nil {
+		t.Fatal("permission to a loopback peer was granted")
+	}
+}
+
+func TestUnpairedClientRefused(t *testing.T) {
+	s, addr := startServer(t, true, func(uId string) bool { return uId == "paired" })
+
+	if _, err := newClient(t, s, addr, "stranger").Allocate(); err == nil {
+		t.Fatal("unpaired client got an allocation")
+	}
+	relay, err := newClient(t, s, addr, "paired").Allocate()
+	if err != nil {
+		t.Fatalf("paired client: %s", err)
+	}
+	_ = relay.Close()
+}
+
+func TestPublicPeer(t *testing.T) {
+	tests := []struct {
+		ip     string
+		public bool
+	}{
+		{"8.8.8.8", true},
+		{"2001:4860:4860::8888", true},
+		{"127.0.0.1", false},
+		{"::1", false},
+		{"10.1.2.3", false},
+		{"172.16.0.1", false},
+		{"192.168.1.1", false},
+		{"fd00::1", false},
+		{"169.254.169.254", false},
+		{"fe80::1", false},
+		{"0.0.0.0", false},
+	}
+	for _, tt := range tests {
+		if got := publicPeer(net.ParseIP(tt.ip)); got != tt.public {
+			t.Errorf("publicPeer(%s) = %t, want %t", tt.ip, got, tt.public)
+		}
+	}
+}
@@ -8,7 +8,7 @@ const (
 	InvalidRequest                   = "the request is not valid"
 	DatabaseErrorNotConnectedMessage = "database not connected"
 
-	ActionConnected = "connected"
+	ActionConnected    = "connected"
 	ActionDisConnected = "dis_connected"
 
 	ActionOfferReq = "offer_req"
@@ -18,11 +18,55 @@ const (
 	ActionAnswerRes = "answer_res"
 	ActionAnswerRec = "answer_rec"
 
+	ActionOfferCollision = "offer_collision"
+
+	ActionRenegotiateRes = "renegotiate_res"
+	ActionRenegotiateReq = "renegotiate_req"
+
+	ActionIceRestartRes = "ice_restart_res"
+	ActionIceRestartReq = "ice_restart_req"
+
+	ActionEndOfCandidatesRes = "end_of_candidates_res"
+	ActionEndOfCandidatesRec = "end_of_candidates_rec"
+
 	ActionIceCandidateRes = "ice_candidate_res"
 	ActionIceCandidateRec = "ice_candidate_rec"
 
 	ActionStartChatReq = "start_chat_req"
 	ActionStartChatAck = "start_chat_ack"
 
+	ActionStopChatReq = "stop_chat_req"
+	ActionStopChatAck = "stop_chat_ack"
+
+	ActionMatchFound     = "match_found"
+	ActionMatchAck       = "match_ack"
+	ActionMatchCancelled = "match_cancelled"
+
+	ActionCallEnded = "call_ended"
+
+	ActionQueueStatus = "queue_status"
+
 	ActionActiveUsers = "active_users"
+
+	ActionPresenceSubscribe = "presence_subscribe"
+	ActionPresenceStats     = "presence_stats"
+
+	ActionPeerReconnected = "peer_reconnected"
+
+	ActionJoinRoom     = "join_room"
+	ActionJoinRoomAck  = "join_room_ack"
+	ActionLeaveRoom    = "leave_room"
+	ActionLeaveRoomAck = "leave_room_ack"
+	ActionRoomMembers  = "room_members"
+
+	ActionCreateInvite  = "create_invite"
+	ActionInviteCreated = "invite_created"
+	ActionJoinInvite    = "join_invite"
+	ActionInviteJoined  = "invite_joined"
+	ActionInviteExpired = "invite_expired"
+
+	ActionBlockUser    = "block_user"
+	ActionBlockUserAck = "block_user_ack"
+
+	ActionError = "error"
 )